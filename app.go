@@ -2,46 +2,115 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
+	"sync"
 	"syscall"
 	"time"
 
 	"gopkg.in/yaml.v3"
-
-	"github.com/ovh/go-ovh/ovh"
 )
 
+// backgroundShutdownTimeout bounds the wait for the webhook deliveries and
+// the on_change hooks on exit.
+const backgroundShutdownTimeout = 30 * time.Second
+
 type domain struct {
-	Domain    string        `yaml:"domain"`
-	SubDomain string        `yaml:"sub_domain"`
-	TTL       time.Duration `yaml:"ttl"`
+	Domain      string        `yaml:"domain"`
+	SubDomain   string        `yaml:"sub_domain"`
+	TTL         time.Duration `yaml:"ttl"`
+	RecordTypes []recordType  `yaml:"record_types"`
+	// Provider is the name of the DNS backend managing the zone.
+	Provider string `yaml:"provider"`
+	// DynDNS2 overrides the global dyndns2 configuration, e.g. to use the
+	// credentials of this hostname only.
+	DynDNS2 dyndns2Config `yaml:"dyndns2"`
+	// OnChange runs after the global hooks when a record of the domain
+	// changed.
+	OnChange []changeHook `yaml:"on_change"`
 }
 
 func (d domain) hostname() string {
 	return d.SubDomain + "." + d.Domain
 }
 
+// backend returns the name of the DNS backend of the domain.
+func (d domain) backend() string {
+	if d.Provider == "" {
+		return defaultBackend
+	}
+
+	return d.Provider
+}
+
+// recordTypes returns the record types to keep updated, A only by default.
+func (d domain) recordTypes() []recordType {
+	if len(d.RecordTypes) == 0 {
+		return []recordType{recordTypeA}
+	}
+
+	return d.RecordTypes
+}
+
 type config struct {
-	Provider      string        `yaml:"provider"`
-	DNSProvider   string        `yaml:"dns_provider"`
-	CheckInterval time.Duration `yaml:"check_interval"`
-	Domains       []domain      `yaml:"domains"`
-	OVH           struct {
-		ApplicationKey    string `yaml:"application_key"`
-		ApplicationSecret string `yaml:"application_secret"`
-		ConsumerKey       string `yaml:"consumer_key"`
-		Endpoint          string `yaml:"endpoint"`
-	} `yaml:"ovh"`
+	Provider         providerList     `yaml:"provider"`
+	ProviderStrategy providerStrategy `yaml:"provider_strategy"`
+	DNSProvider      string           `yaml:"dns_provider"`
+	DNSAuthoritative bool             `yaml:"dns_authoritative"`
+	Reconcile        reconcileMode    `yaml:"reconcile"`
+	Parallelism      int              `yaml:"parallelism"`
+	DomainTimeout    time.Duration    `yaml:"domain_timeout"`
+	RetryInterval    time.Duration    `yaml:"retry_interval"`
+	RetryMaxAttempts int              `yaml:"retry_max_attempts"`
+	CheckInterval    time.Duration    `yaml:"check_interval"`
+	NetworkDebounce  time.Duration    `yaml:"network_debounce"`
+	Domains          []domain         `yaml:"domains"`
+	OVH              ovhConfig        `yaml:"ovh"`
+	RFC2136          rfc2136Config    `yaml:"rfc2136"`
+	DynDNS2          dyndns2Config    `yaml:"dyndns2"`
+	Serve            serveConfig      `yaml:"serve"`
+	StateFile        string           `yaml:"state_file"`
+	MetricsListen    string           `yaml:"metrics_listen"`
+	StatusListen     string           `yaml:"status_listen"`
+	LogLevel         string           `yaml:"log_level"`
+	LogFormat        logFormat        `yaml:"log_format"`
+	Webhooks         []webhookConfig  `yaml:"webhooks"`
+	OnChange         []changeHook     `yaml:"on_change"`
 }
 
 type app struct {
+	// configPath is read again on reload.
+	configPath string
+
+	// mu guards the configuration and what depends on it, replaced on
+	// reload, against the HTTP handlers. The loop is the only writer.
+	mu          sync.RWMutex
 	config      config
-	client      OVHClient
+	backends    map[string]DNSBackend
 	dnsProvider DNSProvider
 	ipProvider  IPProvider
+	metrics     *metrics
+	status      *statusTracker
+	webhooks    *webhookNotifier
+	// hooks runs the on_change hooks.
+	hooks hookQueue
+	// watcher triggers a check on network changes, nil if unsupported.
+	watcher NetworkWatcher
+	// state persists the published records, nil without state file.
+	state *stateFile
+	// zoneLocks holds a mutex per zoneKey.
+	zoneLocks sync.Map
+
+	retryMu sync.Mutex
+	// retries holds the retry state of the failing domains, by hostname.
+	retries map[string]*retryState
+	// clock returns the current time, time.Now if nil.
+	clock func() time.Time
 }
 
 func parseConfig(path string) (config, error) {
@@ -60,6 +129,64 @@ func parseConfig(path string) (config, error) {
 		return config{}, fmt.Errorf("no domains configured")
 	}
 
+	if !cfg.ProviderStrategy.valid() {
+		return config{}, fmt.Errorf("invalid provider strategy %q", cfg.ProviderStrategy)
+	}
+
+	if cfg.RetryMaxAttempts < 0 {
+		return config{}, fmt.Errorf("invalid retry max attempts %d", cfg.RetryMaxAttempts)
+	}
+
+	if cfg.Parallelism < 0 {
+		return config{}, fmt.Errorf("invalid parallelism %d", cfg.Parallelism)
+	}
+
+	if !cfg.Reconcile.valid() {
+		return config{}, fmt.Errorf("invalid reconcile mode %q", cfg.Reconcile)
+	}
+
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		return config{}, err
+	}
+
+	if !cfg.LogFormat.valid() {
+		return config{}, fmt.Errorf("invalid log format %q", cfg.LogFormat)
+	}
+
+	for _, h := range cfg.OnChange {
+		if err := h.validate(); err != nil {
+			return config{}, err
+		}
+	}
+
+	for _, d := range cfg.Domains {
+		switch d.backend() {
+		case backendOVH, backendRFC2136:
+		case backendDynDNS2:
+			if err := cfg.DynDNS2.merge(d.DynDNS2).validate(); err != nil {
+				return config{}, fmt.Errorf("%s: %w", d.hostname(), err)
+			}
+		default:
+			return config{}, fmt.Errorf("%s: unsupported provider %q", d.hostname(), d.Provider)
+		}
+
+		for _, t := range d.RecordTypes {
+			if !t.valid() {
+				return config{}, fmt.Errorf("%s: invalid record type %q", d.hostname(), t)
+			}
+		}
+
+		for _, h := range d.OnChange {
+			if err := h.validate(); err != nil {
+				return config{}, fmt.Errorf("%s: %w", d.hostname(), err)
+			}
+		}
+	}
+
+	if err := cfg.Serve.validate(cfg.Domains); err != nil {
+		return config{}, err
+	}
+
 	return cfg, nil
 }
 
@@ -69,9 +196,58 @@ func newApp(configPath string) (*app, error) {
 		return nil, err
 	}
 
-	app := &app{config: cfg}
-	app.dnsProvider = newDNSProvider(cfg.DNSProvider + ":53")
-	app.ipProvider = newIpProvider()
+	app := &app{
+		configPath: configPath,
+		metrics:    newMetrics(),
+		status:     newStatusTracker(),
+		watcher:    newNetworkWatcher(),
+	}
+	if err := app.apply(cfg); err != nil {
+		return nil, err
+	}
+
+	return app, nil
+}
+
+// apply builds what depends on the configuration, then swaps it all at
+// once. The app is left untouched on error.
+func (a *app) apply(cfg config) error {
+	logger, err := newLogger(os.Stderr, cfg)
+	if err != nil {
+		return err
+	}
+
+	dnsProvider, err := newDNSProvider(cfg.DNSProvider)
+	if err != nil {
+		return err
+	}
+	dnsProvider.authoritative = cfg.DNSAuthoritative
+
+	ipProviders := newIPProviderMux()
+	if err := ipProviders.validate(cfg.Provider); err != nil {
+		return err
+	}
+
+	backends, err := newBackends(cfg, a.metrics)
+	if err != nil {
+		return err
+	}
+	if b, ok := backends[backendDynDNS2].(*dyndns2Backend); ok {
+		if old, ok := a.backends[backendDynDNS2].(*dyndns2Backend); ok {
+			b.keep(old, cfg.Domains)
+		}
+	}
+
+	// The state is only read again if the file changed.
+	state := a.state
+	if cfg.StateFile == "" {
+		state = nil
+	} else if state == nil || state.path != cfg.StateFile {
+		state, err = loadState(cfg.StateFile)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Ensure the check interval is greater or equal to the minimum TTL
 	var minTTL time.Duration
@@ -80,19 +256,31 @@ func newApp(configPath string) (*app, error) {
 			minTTL = d.TTL
 		}
 	}
-	if app.config.CheckInterval < minTTL {
-		app.config.CheckInterval = minTTL
-		fmt.Printf("Using the minimum TTL as the check interval: %s\n", app.config.CheckInterval)
+	raised := cfg.CheckInterval < minTTL
+	if raised {
+		cfg.CheckInterval = minTTL
 	}
 
-	app.client, err = ovh.NewClient(
-		cfg.OVH.Endpoint, cfg.OVH.ApplicationKey,
-		cfg.OVH.ApplicationSecret, cfg.OVH.ConsumerKey)
-	if err != nil {
-		return nil, err
+	a.mu.Lock()
+	a.config = cfg
+	a.dnsProvider = dnsProvider
+	a.ipProvider = ipProviders
+	a.backends = backends
+	a.state = state
+	// The notifier is kept, to wait for its deliveries on exit.
+	if a.webhooks == nil {
+		a.webhooks = newWebhookNotifier(cfg.Webhooks)
+	} else {
+		a.webhooks.setHooks(cfg.Webhooks)
 	}
+	a.mu.Unlock()
 
-	return app, nil
+	slog.SetDefault(logger)
+	if raised {
+		slog.Info("using the minimum TTL as the check interval", "check_interval", cfg.CheckInterval)
+	}
+
+	return nil
 }
 
 func runSetup(configPath string) error {
@@ -101,93 +289,285 @@ func runSetup(configPath string) error {
 		return err
 	}
 
-	client, err := ovh.NewClient(
-		cfg.OVH.Endpoint, cfg.OVH.ApplicationKey,
-		cfg.OVH.ApplicationSecret, "")
-	if err != nil {
-		return err
-	}
-
-	ckReq := client.NewCkRequest()
+	var zones []string
 	for _, d := range cfg.Domains {
-		zone := "/domain/zone/" + d.Domain
-		ckReq.AddRule("GET", zone+"/record")
-		ckReq.AddRule("POST", zone+"/record")
-		ckReq.AddRule("POST", zone+"/refresh")
-		ckReq.AddRule("GET", zone+"/record/*")
-		ckReq.AddRule("PUT", zone+"/record/*")
-		ckReq.AddRule("DELETE", zone+"/record/*")
+		if d.backend() == backendOVH && !slices.Contains(zones, d.Domain) {
+			zones = append(zones, d.Domain)
+		}
 	}
 
-	state, err := ckReq.Do()
-	if err != nil {
-		return err
+	if len(zones) == 0 {
+		return fmt.Errorf("no domains managed by OVH")
 	}
 
-	fmt.Printf("Consumer key: %s\n", state.ConsumerKey)
-	fmt.Printf("Validation URL: %s\n", state.ValidationURL)
-	return nil
+	return runOVHSetup(cfg.OVH, zones)
 }
 
-func (a *app) run() error {
+// signalContext returns a context canceled on SIGINT or SIGTERM.
+func signalContext() (context.Context, context.CancelFunc) {
 	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		<-sigs
-		cancel()
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
 	}()
 
+	return ctx, cancel
+}
+
+func (a *app) run() error {
+	if len(a.config.Provider) == 0 {
+		return fmt.Errorf("no IP provider configured")
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	if err := a.startMetrics(ctx); err != nil {
+		return err
+	}
+
+	if err := a.startStatus(ctx); err != nil {
+		return err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	slog.Info("starting daemon mode")
+	a.loop(ctx, hup)
+	a.waitBackground(backgroundShutdownTimeout)
+	return nil
+}
+
+// backgroundContext returns the context of the work started by an update
+// and outliving it, such as the webhook deliveries and the on_change hooks
+// of a dyndns2 request. The values of ctx are kept, not its cancellation.
+func backgroundContext(ctx context.Context) context.Context {
+	return context.WithoutCancel(ctx)
+}
+
+// waitBackground waits for the webhook deliveries and the on_change hooks
+// still running, at most for the given duration.
+func (a *app) waitBackground(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		a.hooks.wait()
+		a.webhooks.wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("exiting with webhook deliveries or on_change hooks still running")
+	}
+}
+
+// loop checks the domains at the check interval and shortly after the
+// network changes, until the context is done. A value received on reload
+// reloads the configuration file.
+func (a *app) loop(ctx context.Context, reload <-chan os.Signal) {
 	ticker := time.NewTicker(a.config.CheckInterval)
 	defer ticker.Stop()
 
-	fmt.Println("Starting daemon mode")
+	// A burst of network events triggers a single check once they settle.
+	events := a.watchNetwork(ctx)
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	// The failed domains are retried in between the checks.
+	retry := time.NewTimer(time.Hour)
+	retry.Stop()
+	defer retry.Stop()
+	scheduleRetry := func() {
+		if next, ok := a.nextRetry(); ok {
+			retry.Reset(time.Until(next))
+		}
+	}
 
 	a.tryUpdateDomainsIfNeeded(ctx)
+	scheduleRetry()
 
 	for {
 		select {
 		case <-ctx.Done():
-			return nil
+			return
 		case <-ticker.C:
 			a.tryUpdateDomainsIfNeeded(ctx)
+			scheduleRetry()
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			debounce.Reset(a.networkDebounce())
+		case <-debounce.C:
+			slog.Info("network changed, checking the domains")
+			a.tryUpdateDomainsIfNeeded(ctx)
+			scheduleRetry()
+		case <-retry.C:
+			a.retryDueDomains(ctx)
+			scheduleRetry()
+		case <-reload:
+			if !a.reload() {
+				continue
+			}
+			ticker.Reset(a.config.CheckInterval)
+			a.tryUpdateDomainsIfNeeded(ctx)
+			scheduleRetry()
+		}
+	}
+}
+
+// recordTypes returns the record types used by at least one of the domains,
+// A first.
+func recordTypes(domains []domain) []recordType {
+	var types []recordType
+	for _, t := range []recordType{recordTypeA, recordTypeAAAA} {
+		for _, d := range domains {
+			if slices.Contains(d.recordTypes(), t) {
+				types = append(types, t)
+				break
+			}
 		}
 	}
+
+	return types
 }
 
 func (a *app) tryUpdateDomainsIfNeeded(ctx context.Context) {
-	ip, err := a.ipProvider.Get(ctx, a.config.Provider)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to get IP: %s\n", err)
-		return
+	a.updateDomains(ctx, a.config.Domains)
+	a.status.checkCompleted(a.now())
+}
+
+// updateDomains checks the records of the domains and updates the ones not
+// matching the current IP. The result of each domain updates its retry
+// state.
+func (a *app) updateDomains(ctx context.Context, domains []domain) {
+	ips := map[recordType]netip.Addr{}
+	ipErrs := map[recordType]error{}
+	for _, t := range recordTypes(domains) {
+		ip, err := a.fetchIP(ctx, t)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to get the IP", "type", t, "error", err)
+			ipErrs[t] = fmt.Errorf("failed to get %s IP: %w", t, err)
+			continue
+		}
+
+		ips[t] = ip
+	}
+
+	var snapshots map[zoneKey]zoneSnapshot
+	if a.config.Reconcile == reconcileZone {
+		snapshots = a.fetchZones(ctx, domains)
 	}
 
-	if !ip.IsValid() {
-		fmt.Fprintf(os.Stderr, "got invalid IP from provider\n")
-		return
+	// Look up the domains concurrently, the results keep their order.
+	domainChanges := make([][]recordChange, len(domains))
+	domainErrs := make([][]error, len(domains))
+	a.runTasks(ctx, len(domains), a.domainTimeout(), func(ctx context.Context, i int) {
+		d := domains[i]
+		snapshot, ok := snapshots[zoneKey{backend: d.backend(), zone: d.Domain}]
+		for _, t := range d.recordTypes() {
+			ip, found := ips[t]
+			if !found {
+				if err := ipErrs[t]; err != nil {
+					domainErrs[i] = append(domainErrs[i], err)
+				}
+				continue
+			}
+			a.status.setLocalIP(d.hostname(), ip)
+
+			if ok {
+				c, needed := snapshot.change(ctx, d, ip)
+				switch {
+				case !needed:
+					a.state.setPublished(d.hostname(), t, publishedRecord{IP: ip, UpdatedAt: a.now()})
+					a.status.setZoneTarget(d.hostname(), t, ip.String())
+					a.metrics.setPublished(d.hostname(), ip)
+				case c.known && c.current != nil:
+					a.status.setZoneTarget(d.hostname(), t, c.current.Target)
+				case c.known:
+					a.status.setZoneTarget(d.hostname(), t, "")
+				}
+				if needed {
+					domainChanges[i] = append(domainChanges[i], c)
+				}
+				continue
+			}
+
+			needed, err := a.recordNeedsUpdate(ctx, d, ip)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to check the record", "hostname", d.hostname(), "type", t, "error", err)
+				domainErrs[i] = append(domainErrs[i], err)
+				continue
+			}
+
+			switch {
+			case needed && a.recentlyPublished(d, ip):
+				// The resolver may serve the previous address until its
+				// TTL expires.
+				slog.DebugContext(ctx, "address published recently, waiting for the DNS", "hostname", d.hostname(), "ip", ip)
+				a.metrics.setPublished(d.hostname(), ip)
+			case needed:
+				domainChanges[i] = append(domainChanges[i], recordChange{domain: d, ip: ip})
+			default:
+				a.state.setPublished(d.hostname(), t, publishedRecord{IP: ip, UpdatedAt: a.now()})
+				a.metrics.setPublished(d.hostname(), ip)
+			}
+		}
+	})
+
+	var changes []recordChange
+	var owners []int
+	for i, c := range domainChanges {
+		changes = append(changes, c...)
+		for range c {
+			owners = append(owners, i)
+		}
 	}
 
-	for _, d := range a.config.Domains {
-		if err := a.updateDomainIfNeeded(ctx, d, ip); err != nil {
-			fmt.Fprintf(os.Stderr, "%s: failed to update domain: %s\n", d.hostname(), err)
+	for i, err := range a.updateZones(ctx, changes) {
+		if err != nil {
+			c := changes[i]
+			slog.ErrorContext(ctx, "failed to update the record", "hostname", c.domain.hostname(),
+				"zone", c.domain.Domain, "type", recordTypeOf(c.ip), "new_ip", c.ip, "error", err)
+			domainErrs[owners[i]] = append(domainErrs[owners[i]], err)
 		}
 	}
+
+	for i, d := range domains {
+		a.recordResult(ctx, d, errors.Join(domainErrs[i]...))
+	}
+
+	a.saveState(ctx)
 }
 
-func (a *app) updateDomainIfNeeded(ctx context.Context, d domain, ip netip.Addr) error {
-	dnsIP, err := a.dnsProvider.Lookup(ctx, d.hostname())
+// recordNeedsUpdate returns true if the DNS does not resolve the domain to
+// the given address.
+func (a *app) recordNeedsUpdate(ctx context.Context, d domain, ip netip.Addr) (bool, error) {
+	dnsIP, err := a.dnsProvider.Lookup(ctx, d.hostname(), recordTypeOf(ip))
 	if err != nil {
-		return err
+		a.metrics.observeDNSLookup(d.hostname(), recordTypeOf(ip), "error")
+		return false, err
 	}
 
+	a.status.setDNSIP(d.hostname(), recordTypeOf(ip), dnsIP)
 	if ip == dnsIP {
-		return nil
+		a.metrics.observeDNSLookup(d.hostname(), recordTypeOf(ip), "match")
+		return false, nil
 	}
 
-	fmt.Printf("%s: local IP: %s, DNS IP: %s\n", d.hostname(), ip, dnsIP)
-
-	_, err = a.updateZoneRecord(d, ip)
-	return err
+	a.metrics.observeDNSLookup(d.hostname(), recordTypeOf(ip), "mismatch")
+	slog.InfoContext(ctx, "DNS record out of date", "hostname", d.hostname(), "old_ip", dnsIP, "new_ip", ip)
+	return true, nil
 }
@@ -4,17 +4,24 @@ import (
 	"context"
 	"fmt"
 	"net/netip"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 type mockDNSProvider struct {
+	mu      sync.Mutex
 	addr    netip.Addr
 	err     error
 	lookups []string
 }
 
-func (m *mockDNSProvider) Lookup(_ context.Context, host string) (netip.Addr, error) {
+func (m *mockDNSProvider) Lookup(_ context.Context, host string, _ recordType) (netip.Addr, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	m.lookups = append(m.lookups, host)
 	return m.addr, m.err
 }
@@ -23,14 +30,20 @@ type mockIPProvider struct {
 	addr netip.Addr
 	err  error
 	gets int
+
+	// addrs overrides addr for a given record type when set.
+	addrs map[recordType]netip.Addr
 }
 
-func (m *mockIPProvider) Get(_ context.Context, _ string) (netip.Addr, error) {
+func (m *mockIPProvider) Get(_ context.Context, _ ipSource, t recordType) (netip.Addr, error) {
 	m.gets++
+	if addr, ok := m.addrs[t]; ok {
+		return addr, m.err
+	}
 	return m.addr, m.err
 }
 
-func TestUpdateDomainIfNeeded(t *testing.T) {
+func TestRecordNeedsUpdate(t *testing.T) {
 	ip := netip.MustParseAddr("203.0.113.1")
 	oldIP := netip.MustParseAddr("198.51.100.1")
 	d := testDomain()
@@ -70,20 +83,12 @@ func TestUpdateDomainIfNeeded(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			ovhMock := &mockOVHClient{
-				getFunc: func(url string, resType interface{}) error {
-					jsonInto([]int{}, resType)
-					return nil
-				},
-			}
-
 			a := &app{
 				config:      config{Domains: []domain{d}},
-				client:      ovhMock,
 				dnsProvider: &mockDNSProvider{addr: tc.dnsIP, err: tc.dnsErr},
 			}
 
-			err := a.updateDomainIfNeeded(context.Background(), d, tc.ip)
+			needed, err := a.recordNeedsUpdate(context.Background(), d, tc.ip)
 
 			if tc.wantErr {
 				if err == nil {
@@ -96,21 +101,22 @@ func TestUpdateDomainIfNeeded(t *testing.T) {
 				t.Fatalf("unexpected error: %v", err)
 			}
 
-			updated := len(ovhMock.postCalls) > 0 || len(ovhMock.putCalls) > 0
-			if updated != tc.wantUpdate {
-				t.Fatalf("update happened: %v, want: %v", updated, tc.wantUpdate)
+			if needed != tc.wantUpdate {
+				t.Fatalf("update needed: %v, want: %v", needed, tc.wantUpdate)
 			}
 		})
 	}
 }
 
+var testProviders = providerList{{URL: "http://ip.example.net"}}
+
 func TestTryUpdateDomainsIfNeeded(t *testing.T) {
 	ip := netip.MustParseAddr("203.0.113.1")
 
 	t.Run("ip provider error", func(t *testing.T) {
 		dns := &mockDNSProvider{}
 		a := &app{
-			config:      config{Domains: []domain{testDomain()}},
+			config:      config{Provider: testProviders, Domains: []domain{testDomain()}},
 			ipProvider:  &mockIPProvider{err: fmt.Errorf("connection refused")},
 			dnsProvider: dns,
 		}
@@ -125,7 +131,7 @@ func TestTryUpdateDomainsIfNeeded(t *testing.T) {
 	t.Run("ip provider returns zero addr", func(t *testing.T) {
 		dns := &mockDNSProvider{}
 		a := &app{
-			config:      config{Domains: []domain{testDomain()}},
+			config:      config{Provider: testProviders, Domains: []domain{testDomain()}},
 			ipProvider:  &mockIPProvider{},
 			dnsProvider: dns,
 		}
@@ -145,8 +151,8 @@ func TestTryUpdateDomainsIfNeeded(t *testing.T) {
 		ipMock := &mockIPProvider{addr: ip}
 
 		a := &app{
-			config:      config{Domains: []domain{d1, d2}},
-			client:      &mockOVHClient{},
+			config:      config{Provider: testProviders, Domains: []domain{d1, d2}},
+			backends:    testBackends(&mockOVHClient{}),
 			ipProvider:  ipMock,
 			dnsProvider: dns,
 		}
@@ -159,11 +165,80 @@ func TestTryUpdateDomainsIfNeeded(t *testing.T) {
 		if len(dns.lookups) != 2 {
 			t.Fatalf("expected 2 DNS lookups, got %d", len(dns.lookups))
 		}
+		// The domains are looked up concurrently.
+		slices.Sort(dns.lookups)
 		if dns.lookups[0] != "a.example.com" {
-			t.Fatalf("expected first lookup a.example.com, got %s", dns.lookups[0])
+			t.Fatalf("expected lookup a.example.com, got %s", dns.lookups[0])
 		}
 		if dns.lookups[1] != "b.example.org" {
-			t.Fatalf("expected second lookup b.example.org, got %s", dns.lookups[1])
+			t.Fatalf("expected lookup b.example.org, got %s", dns.lookups[1])
+		}
+	})
+
+	t.Run("ipv4 and ipv6 records", func(t *testing.T) {
+		ip6 := netip.MustParseAddr("2001:db8::1")
+		d := testDomain()
+		d.RecordTypes = []recordType{recordTypeA, recordTypeAAAA}
+
+		ovhMock := &mockOVHClient{
+			getFunc: func(url string, resType any) error {
+				jsonInto([]int{}, resType)
+				return nil
+			},
+		}
+		ipMock := &mockIPProvider{addrs: map[recordType]netip.Addr{
+			recordTypeA:    ip,
+			recordTypeAAAA: ip6,
+		}}
+
+		a := &app{
+			config:      config{Provider: testProviders, Domains: []domain{d}},
+			backends:    testBackends(ovhMock),
+			ipProvider:  ipMock,
+			dnsProvider: &mockDNSProvider{},
+		}
+
+		a.tryUpdateDomainsIfNeeded(context.Background())
+
+		if ipMock.gets != 2 {
+			t.Fatalf("expected 2 IP fetches, got %d", ipMock.gets)
+		}
+
+		want := []string{"fieldType=A&", "fieldType=AAAA&"}
+		if len(ovhMock.getCalls) != len(want) {
+			t.Fatalf("expected %d GET calls, got %v", len(want), ovhMock.getCalls)
+		}
+		for i, w := range want {
+			if !strings.Contains(ovhMock.getCalls[i], w) {
+				t.Fatalf("expected GET call %q to contain %q", ovhMock.getCalls[i], w)
+			}
+		}
+	})
+
+	t.Run("one refresh per zone", func(t *testing.T) {
+		domains := []domain{
+			{Domain: "example.com", SubDomain: "a", TTL: 60 * time.Second},
+			{Domain: "example.org", SubDomain: "a", TTL: 60 * time.Second},
+			{Domain: "example.com", SubDomain: "b", TTL: 60 * time.Second},
+			{Domain: "example.com", SubDomain: "c", TTL: 60 * time.Second},
+		}
+		backend := newMockBackend()
+
+		a := &app{
+			config:      config{Provider: testProviders, Domains: domains},
+			backends:    map[string]DNSBackend{defaultBackend: backend},
+			ipProvider:  &mockIPProvider{addr: ip},
+			dnsProvider: &mockDNSProvider{},
+		}
+
+		a.tryUpdateDomainsIfNeeded(context.Background())
+
+		if len(backend.creates) != 4 {
+			t.Fatalf("expected 4 creates, got %d", len(backend.creates))
+		}
+		slices.Sort(backend.refreshes)
+		if fmt.Sprint(backend.refreshes) != "[example.com example.org]" {
+			t.Fatalf("expected one refresh per zone, got %v", backend.refreshes)
 		}
 	})
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// Supported DNS backends, selected per domain with the provider key.
+const (
+	backendOVH     = "ovh"
+	backendRFC2136 = "rfc2136"
+	backendDynDNS2 = "dyndns2"
+)
+
+// defaultBackend is used by the domains without provider.
+const defaultBackend = backendOVH
+
+// record is a DNS record as seen by a backend.
+type record struct {
+	// ID identifies the record in the backend, if the backend has one.
+	ID     string
+	Type   recordType
+	Target string
+	TTL    time.Duration
+}
+
+func newRecord(d domain, ip netip.Addr) record {
+	return record{
+		Type:   recordTypeOf(ip),
+		Target: ip.String(),
+		TTL:    d.TTL,
+	}
+}
+
+// DNSBackend manages the records of the domains in a DNS zone.
+type DNSBackend interface {
+	// Find returns the record of the given type for the domain, or nil if
+	// there is none.
+	Find(ctx context.Context, d domain, t recordType) (*record, error)
+	Create(ctx context.Context, d domain, r record) error
+	Update(ctx context.Context, d domain, r record) error
+	Delete(ctx context.Context, d domain, r record) error
+	// Refresh commits the changes made to the zone.
+	Refresh(ctx context.Context, zone string) error
+}
+
+// ZoneLister is implemented by the backends able to fetch all the records of
+// a zone at once. The records returned may have no ID.
+type ZoneLister interface {
+	ListZone(ctx context.Context, zone string) ([]namedRecord, error)
+}
+
+// StableIDBackend is implemented by the backends whose record IDs stay the
+// same when the records are updated, such as OVH. Their IDs are kept in the
+// state file to skip the lookups.
+type StableIDBackend interface {
+	StableIDs()
+}
+
+// newBackends returns the backends used by the configured domains.
+func newBackends(cfg config, m *metrics) (map[string]DNSBackend, error) {
+	backends := map[string]DNSBackend{}
+	for _, d := range cfg.Domains {
+		name := d.backend()
+		if _, ok := backends[name]; ok {
+			continue
+		}
+
+		var backend DNSBackend
+		var err error
+		switch name {
+		case backendOVH:
+			backend, err = newOVHBackend(cfg.OVH, m)
+		case backendRFC2136:
+			backend, err = newRFC2136Backend(cfg.RFC2136)
+		case backendDynDNS2:
+			backend = newDynDNS2Backend(cfg.DynDNS2)
+		default:
+			err = fmt.Errorf("unsupported provider %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		backends[name] = backend
+	}
+
+	return backends, nil
+}
+
+func (a *app) backend(d domain) (DNSBackend, error) {
+	backend, ok := a.backends[d.backend()]
+	if !ok {
+		return nil, permanent(fmt.Errorf("no %s provider configured", d.backend()))
+	}
+
+	return backend, nil
+}
+
+// applyZoneRecord creates or updates the record of the change without
+// refreshing the zone, and returns whether the record changed. The current
+// record is stored in the change once found.
+func (a *app) applyZoneRecord(ctx context.Context, c *recordChange) (*record, bool, error) {
+	d, ip := c.domain, c.ip
+	backend, err := a.backend(d)
+	if err != nil {
+		return nil, false, err
+	}
+
+	t := recordTypeOf(ip)
+	current := c.current
+	if !c.known {
+		current, err = backend.Find(ctx, d, t)
+		if err != nil {
+			return nil, false, err
+		}
+		c.known, c.current = true, current
+	}
+
+	r := newRecord(d, ip)
+	if current == nil {
+		slog.InfoContext(ctx, "creating the zone record", "hostname", d.hostname(), "zone", d.Domain,
+			"type", t, "new_ip", ip)
+		if err := backend.Create(ctx, d, r); err != nil {
+			return nil, false, err
+		}
+	} else {
+		if current.Target == r.Target {
+			slog.InfoContext(ctx, "zone record already up to date", "hostname", d.hostname(), "zone", d.Domain,
+				"record_id", current.ID, "new_ip", ip)
+			return current, false, nil
+		}
+
+		slog.InfoContext(ctx, "updating the zone record", "hostname", d.hostname(), "zone", d.Domain,
+			"record_id", current.ID, "old_ip", current.Target, "new_ip", ip)
+
+		r.ID = current.ID
+		if err := backend.Update(ctx, d, r); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return &r, true, nil
+}
+
+// recordChanged sends the update event of the applied change and runs the
+// on_change hooks.
+func (a *app) recordChanged(ctx context.Context, c recordChange) {
+	e := webhookEvent{
+		Event:    webhookEventUpdate,
+		Hostname: c.domain.hostname(),
+		Type:     recordTypeOf(c.ip),
+		NewIP:    c.ip.String(),
+		Time:     a.now(),
+		Result:   "success",
+	}
+	if c.current != nil {
+		e.OldIP = c.current.Target
+	}
+
+	a.webhooks.notify(ctx, e)
+	a.runChangeHooks(ctx, c)
+}
+
+// recordChange is an address to publish for a domain.
+type recordChange struct {
+	domain domain
+	ip     netip.Addr
+	// known is true when the current record was already fetched, nil if
+	// there is none.
+	known   bool
+	current *record
+}
+
+// zoneKey identifies a zone managed by a backend.
+type zoneKey struct {
+	backend string
+	zone    string
+}
+
+// updateZones applies the changes grouped by zone, in the order the zones
+// first appear, and refreshes each modified zone once. The returned errors
+// match the changes.
+func (a *app) updateZones(ctx context.Context, changes []recordChange) []error {
+	var zones []zoneKey
+	byZone := map[zoneKey][]int{}
+	for i, c := range changes {
+		k := zoneKey{backend: c.domain.backend(), zone: c.domain.Domain}
+		if _, ok := byZone[k]; !ok {
+			zones = append(zones, k)
+		}
+		byZone[k] = append(byZone[k], i)
+	}
+
+	changes = slices.Clone(changes)
+	for i, c := range changes {
+		changes[i] = a.stateChange(c)
+	}
+
+	// The zones are updated concurrently, the changes of a zone one at a
+	// time. Each change has its own timeout.
+	errs := make([]error, len(changes))
+	a.runTasks(ctx, len(zones), 0, func(ctx context.Context, i int) {
+		a.updateZone(ctx, zones[i], changes, byZone[zones[i]], errs)
+	})
+
+	return errs
+}
+
+// updateZone applies the changes of the given indexes, all in the same zone,
+// then refreshes the zone if needed and logs a summary.
+func (a *app) updateZone(ctx context.Context, k zoneKey, changes []recordChange, indexes []int, errs []error) {
+	defer a.lockZone(k)()
+
+	records := map[int]*record{}
+	var changed []int
+	var unchanged, failed int
+	for _, i := range indexes {
+		changeCtx, cancel := context.WithTimeout(ctx, a.domainTimeout())
+		r, ok, err := a.applyZoneRecord(changeCtx, &changes[i])
+		cancel()
+		records[i] = r
+		switch {
+		case err != nil:
+			errs[i] = err
+			failed++
+			a.metrics.observeUpdate(changes[i].domain.hostname(), recordTypeOf(changes[i].ip), "failure")
+		case ok:
+			changed = append(changed, i)
+		default:
+			unchanged++
+		}
+	}
+
+	status := "unchanged"
+	if len(changed) > 0 {
+		// The backend exists, at least one change went through it.
+		backend, _ := a.backend(changes[changed[0]].domain)
+		refreshCtx, cancel := context.WithTimeout(ctx, a.domainTimeout())
+		err := backend.Refresh(refreshCtx, k.zone)
+		cancel()
+		if err != nil {
+			for _, i := range changed {
+				errs[i] = err
+				a.metrics.observeUpdate(changes[i].domain.hostname(), recordTypeOf(changes[i].ip), "failure")
+			}
+			failed += len(changed)
+			changed = nil
+			status = "refresh failed"
+		} else {
+			for _, i := range changed {
+				a.metrics.observeUpdate(changes[i].domain.hostname(), recordTypeOf(changes[i].ip), "success")
+				a.recordChanged(ctx, changes[i])
+			}
+			status = "refreshed"
+		}
+	}
+
+	for _, i := range indexes {
+		c := changes[i]
+		a.statePublished(c, records[i], slices.Contains(changed, i), errs[i])
+		if errs[i] != nil {
+			continue
+		}
+
+		a.metrics.setPublished(c.domain.hostname(), c.ip)
+		a.status.setZoneTarget(c.domain.hostname(), recordTypeOf(c.ip), c.ip.String())
+		if slices.Contains(changed, i) {
+			a.status.setUpdated(c.domain.hostname(), a.now())
+		}
+	}
+
+	slog.InfoContext(ctx, "DNS zone "+status, "zone", k.zone,
+		"updated", len(changed), "unchanged", unchanged, "failed", failed)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// mockBackend stores the records in memory, keyed by hostname and type.
+type mockBackend struct {
+	mu         sync.Mutex
+	records    map[string]record
+	err        error
+	refreshErr error
+
+	creates   []record
+	updates   []record
+	deletes   []record
+	refreshes []string
+}
+
+func newMockBackend() *mockBackend {
+	return &mockBackend{records: map[string]record{}}
+}
+
+func mockBackendKey(d domain, t recordType) string {
+	return d.hostname() + "/" + string(t)
+}
+
+func (m *mockBackend) Find(_ context.Context, d domain, t recordType) (*record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	r, ok := m.records[mockBackendKey(d, t)]
+	if !ok {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+func (m *mockBackend) Create(_ context.Context, d domain, r record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.creates = append(m.creates, r)
+	m.records[mockBackendKey(d, r.Type)] = r
+	return nil
+}
+
+func (m *mockBackend) Update(_ context.Context, d domain, r record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.updates = append(m.updates, r)
+	m.records[mockBackendKey(d, r.Type)] = r
+	return nil
+}
+
+func (m *mockBackend) Delete(_ context.Context, d domain, r record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deletes = append(m.deletes, r)
+	delete(m.records, mockBackendKey(d, r.Type))
+	return nil
+}
+
+func (m *mockBackend) Refresh(_ context.Context, zone string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.refreshes = append(m.refreshes, zone)
+	return m.refreshErr
+}
+
+// updateRecord publishes the address of the domain through updateZones, as
+// an update cycle does.
+func updateRecord(a *app, d domain, ip netip.Addr) error {
+	return a.updateZones(context.Background(), []recordChange{{domain: d, ip: ip}})[0]
+}
+
+func TestUpdateZonesBackends(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+	d1 := domain{Domain: "example.com", SubDomain: "home"}
+	d2 := domain{Domain: "example.org", SubDomain: "home", Provider: "other"}
+
+	ovhBackend := newMockBackend()
+	otherBackend := newMockBackend()
+	otherBackend.records[mockBackendKey(d2, recordTypeA)] = record{ID: "7", Type: recordTypeA, Target: "198.51.100.1"}
+
+	a := &app{
+		backends: map[string]DNSBackend{
+			backendOVH: ovhBackend,
+			"other":    otherBackend,
+		},
+	}
+
+	if err := updateRecord(a, d1, ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ovhBackend.creates) != 1 || len(otherBackend.creates) != 0 {
+		t.Fatalf("expected 1 create on the default backend, got %d and %d",
+			len(ovhBackend.creates), len(otherBackend.creates))
+	}
+
+	if err := updateRecord(a, d2, ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(otherBackend.updates) != 1 || otherBackend.updates[0].ID != "7" {
+		t.Fatalf("expected 1 update of record 7, got %v", otherBackend.updates)
+	}
+
+	if fmt.Sprint(ovhBackend.refreshes, otherBackend.refreshes) != "[example.com] [example.org]" {
+		t.Fatalf("unexpected refreshes: %v %v", ovhBackend.refreshes, otherBackend.refreshes)
+	}
+
+	d3 := domain{Domain: "example.net", SubDomain: "home", Provider: "missing"}
+	if err := updateRecord(a, d3, ip); err == nil {
+		t.Fatal("expected error for a missing backend, got nil")
+	}
+}
+
+func TestUpdateZones(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+	ip6 := netip.MustParseAddr("2001:db8::1")
+	a1 := domain{Domain: "example.com", SubDomain: "a"}
+	b1 := domain{Domain: "example.com", SubDomain: "b"}
+	c1 := domain{Domain: "example.com", SubDomain: "c"}
+	a2 := domain{Domain: "example.org", SubDomain: "a"}
+	other := domain{Domain: "example.org", SubDomain: "a", Provider: "other"}
+	missing := domain{Domain: "example.com", SubDomain: "d", Provider: "missing"}
+
+	tests := []struct {
+		name          string
+		changes       []recordChange
+		refreshErr    error
+		wantRefreshes string
+		wantOther     string
+		wantErrs      []bool
+		wantCreates   int
+	}{
+		{
+			name: "one refresh per zone",
+			changes: []recordChange{
+				{domain: a1, ip: ip},
+				{domain: a2, ip: ip},
+				{domain: b1, ip: ip},
+				{domain: b1, ip: ip6},
+				{domain: c1, ip: ip},
+			},
+			wantRefreshes: "[example.com example.org]",
+			wantOther:     "[]",
+			wantErrs:      []bool{false, false, false, false, false},
+			wantCreates:   4,
+		},
+		{
+			name: "zones of other backends",
+			changes: []recordChange{
+				{domain: a2, ip: ip},
+				{domain: other, ip: ip},
+				{domain: missing, ip: ip},
+			},
+			wantRefreshes: "[example.org]",
+			wantOther:     "[example.org]",
+			wantErrs:      []bool{false, false, true},
+			wantCreates:   1,
+		},
+		{
+			name: "unchanged records",
+			changes: []recordChange{
+				{domain: c1, ip: netip.MustParseAddr("198.51.100.1")},
+			},
+			wantRefreshes: "[]",
+			wantOther:     "[]",
+			wantErrs:      []bool{false},
+		},
+		{
+			name: "refresh error",
+			changes: []recordChange{
+				{domain: a1, ip: ip},
+				{domain: c1, ip: netip.MustParseAddr("198.51.100.1")},
+			},
+			refreshErr:    fmt.Errorf("api unavailable"),
+			wantRefreshes: "[example.com]",
+			wantOther:     "[]",
+			wantErrs:      []bool{true, false},
+			wantCreates:   1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newMockBackend()
+			backend.refreshErr = tc.refreshErr
+			backend.records[mockBackendKey(c1, recordTypeA)] = record{ID: "1", Type: recordTypeA, Target: "198.51.100.1"}
+			otherBackend := newMockBackend()
+
+			a := &app{
+				backends: map[string]DNSBackend{
+					defaultBackend: backend,
+					"other":        otherBackend,
+				},
+			}
+
+			errs := a.updateZones(context.Background(), tc.changes)
+
+			if len(errs) != len(tc.wantErrs) {
+				t.Fatalf("got %d errors, want %d", len(errs), len(tc.wantErrs))
+			}
+			for i, wantErr := range tc.wantErrs {
+				if (errs[i] != nil) != wantErr {
+					t.Fatalf("change %d: got error %v, want error: %v", i, errs[i], wantErr)
+				}
+			}
+
+			slices.Sort(backend.refreshes)
+			if got := fmt.Sprint(backend.refreshes); got != tc.wantRefreshes {
+				t.Fatalf("got refreshes %s, want %s", got, tc.wantRefreshes)
+			}
+
+			if got := fmt.Sprint(otherBackend.refreshes); got != tc.wantOther {
+				t.Fatalf("got other backend refreshes %s, want %s", got, tc.wantOther)
+			}
+
+			if len(backend.creates) != tc.wantCreates {
+				t.Fatalf("got %d creates, want %d", len(backend.creates), tc.wantCreates)
+			}
+		})
+	}
+}
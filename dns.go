@@ -2,55 +2,405 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
+// nsNegativeTTL is the time a name without nameservers is remembered as
+// not being a zone.
+const nsNegativeTTL = 5 * time.Minute
+
+// dnsTimeout is the time given to a nameserver to answer a query.
+const dnsTimeout = 5 * time.Second
+
+type recordType string
+
+const (
+	recordTypeA    recordType = "A"
+	recordTypeAAAA recordType = "AAAA"
+)
+
+// recordTypeOf returns the record type able to hold the given address.
+func recordTypeOf(addr netip.Addr) recordType {
+	if addr.Unmap().Is4() {
+		return recordTypeA
+	}
+
+	return recordTypeAAAA
+}
+
+// dnsType returns the DNS message type of the record type.
+func (t recordType) dnsType() dnsmessage.Type {
+	if t == recordTypeAAAA {
+		return dnsmessage.TypeAAAA
+	}
+
+	return dnsmessage.TypeA
+}
+
+func (t recordType) valid() bool {
+	return t == recordTypeA || t == recordTypeAAAA
+}
+
+// network returns the IP network matching the record type, as expected by
+// the net package lookup functions.
+func (t recordType) network() string {
+	if t == recordTypeAAAA {
+		return "ip6"
+	}
+
+	return "ip4"
+}
+
+// match returns true if the address can be stored in a record of this type.
+func (t recordType) match(addr netip.Addr) bool {
+	return addr.IsValid() && recordTypeOf(addr) == t
+}
+
 type DNSProvider interface {
-	Lookup(ctx context.Context, provider string) (netip.Addr, error)
+	Lookup(ctx context.Context, host string, t recordType) (netip.Addr, error)
 }
 
 type dnsProvider struct {
-	resolver *net.Resolver
+	transport dnsTransport
+	// authoritative makes the lookups query the nameservers of the zone
+	// directly, with recursion disabled, instead of the resolver.
+	authoritative bool
+	// nsPort is the port used to query the nameservers of the zone.
+	nsPort string
+
+	mu sync.Mutex
+	// nameservers caches the nameservers found for a name, for their TTL.
+	nameservers map[string]nsCacheEntry
+	// clock returns the current time, time.Now if nil.
+	clock func() time.Time
+}
+
+// nsCacheEntry holds the addresses of the nameservers of a name, none if it
+// is not a zone.
+type nsCacheEntry struct {
+	servers []string
+	expires time.Time
 }
 
-func newDNSProvider(provider string) *dnsProvider {
-	dns := &dnsProvider{
-		resolver: &net.Resolver{PreferGo: true},
+func newDNSProvider(provider string) (*dnsProvider, error) {
+	transport, err := newDNSTransport(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dnsProvider{
+		transport: transport,
+		nsPort:    "53",
+	}, nil
+}
+
+// newResolver returns a resolver sending all its queries to the given server
+// using the given network.
+func newResolver(network, server string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
 	}
-	dns.resolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
-		var d net.Dialer
-		return d.DialContext(ctx, "udp", provider)
+}
+
+func (dns *dnsProvider) Lookup(ctx context.Context, host string, t recordType) (netip.Addr, error) {
+	if dns.authoritative {
+		return dns.lookupAuthoritative(ctx, host, t)
 	}
 
-	return dns
+	var addr netip.Addr
+	name, err := fqdn(host)
+	if err != nil {
+		return addr, err
+	}
+
+	resp, err := dnsQuery(ctx, dns.transport, name, t.dnsType(), true)
+	if err != nil {
+		return addr, err
+	}
+
+	return answerAddr(resp, t)
 }
 
-func (dns *dnsProvider) Lookup(ctx context.Context, host string) (netip.Addr, error) {
+// lookupAuthoritative queries the nameservers of the zone of the host in turn
+// and returns the address found in the first authoritative answer. This
+// reflects the current state of the zone, without any cache in between.
+func (dns *dnsProvider) lookupAuthoritative(ctx context.Context, host string, t recordType) (netip.Addr, error) {
 	var addr netip.Addr
-	addrs, err := dns.resolver.LookupHost(ctx, host)
+	servers, err := dns.zoneNameservers(ctx, host)
 	if err != nil {
-		var dnsError *net.DNSError
-		if !errors.As(err, &dnsError) {
-			return addr, err
+		return addr, err
+	}
+
+	name, err := fqdn(host)
+	if err != nil {
+		return addr, err
+	}
+
+	var errs []error
+	for _, server := range servers {
+		resp, err := dnsQuery(ctx, &udpTransport{server: server}, name, t.dnsType(), false)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", server, err))
+			continue
+		}
+
+		if !resp.Authoritative {
+			errs = append(errs, fmt.Errorf("%s: non authoritative answer", server))
+			continue
 		}
 
-		if dnsError.IsTimeout {
-			return addr, fmt.Errorf("dns timeout: %w", err)
+		return answerAddr(resp, t)
+	}
+
+	return addr, fmt.Errorf("no authoritative answer for %s: %w", host, errors.Join(errs...))
+}
+
+// zoneNameservers finds the zone of the host by looking for NS records on the
+// host and its parents, and returns the addresses of its nameservers.
+func (dns *dnsProvider) zoneNameservers(ctx context.Context, host string) ([]string, error) {
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	for i := 0; i < len(labels)-1; i++ {
+		zone := strings.Join(labels[i:], ".")
+		servers, ok := dns.cachedNameservers(zone)
+		if !ok {
+			var ttl time.Duration
+			var err error
+			servers, ttl, err = dns.resolveNameservers(ctx, zone)
+			if err != nil {
+				return nil, err
+			}
+			dns.cacheNameservers(zone, servers, ttl)
 		}
 
-		if dnsError.IsNotFound {
-			return addr, nil
+		if len(servers) > 0 {
+			return servers, nil
 		}
+	}
 
-		return addr, err
+	return nil, fmt.Errorf("no nameservers found for %s", host)
+}
+
+// resolveNameservers returns the addresses of the nameservers of the zone,
+// none if the name is not a zone, and the time they can be cached.
+func (dns *dnsProvider) resolveNameservers(ctx context.Context, zone string) ([]string, time.Duration, error) {
+	nss, ttl, err := dns.lookupNS(ctx, zone)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to find the nameservers of %s: %w", zone, err)
+	}
+
+	if len(nss) == 0 {
+		return nil, nsNegativeTTL, nil
+	}
+
+	var servers []string
+	for _, ns := range nss {
+		for _, t := range []recordType{recordTypeA, recordTypeAAAA} {
+			resp, err := dnsQuery(ctx, dns.transport, ns, t.dnsType(), true)
+			if err != nil {
+				continue
+			}
+
+			for _, answer := range resp.Answers {
+				if a, ok := resourceAddr(answer.Body); ok {
+					servers = append(servers, net.JoinHostPort(a.String(), dns.nsPort))
+					ttl = min(ttl, time.Duration(answer.Header.TTL)*time.Second)
+				}
+			}
+		}
 	}
 
-	if len(addrs) != 1 {
+	if len(servers) == 0 {
+		return nil, 0, fmt.Errorf("failed to resolve the nameservers of %s", zone)
+	}
+
+	return servers, ttl, nil
+}
+
+func (dns *dnsProvider) cachedNameservers(zone string) ([]string, bool) {
+	dns.mu.Lock()
+	defer dns.mu.Unlock()
+
+	e, ok := dns.nameservers[zone]
+	if !ok || !dns.now().Before(e.expires) {
+		return nil, false
+	}
+
+	return e.servers, true
+}
+
+func (dns *dnsProvider) cacheNameservers(zone string, servers []string, ttl time.Duration) {
+	dns.mu.Lock()
+	defer dns.mu.Unlock()
+
+	if dns.nameservers == nil {
+		dns.nameservers = map[string]nsCacheEntry{}
+	}
+	dns.nameservers[zone] = nsCacheEntry{servers: servers, expires: dns.now().Add(ttl)}
+}
+
+func (dns *dnsProvider) now() time.Time {
+	if dns.clock != nil {
+		return dns.clock()
+	}
+
+	return time.Now()
+}
+
+// lookupNS returns the nameservers of the zone, if any, and the lowest TTL
+// of their records.
+func (dns *dnsProvider) lookupNS(ctx context.Context, zone string) ([]dnsmessage.Name, time.Duration, error) {
+	name, err := fqdn(zone)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := dnsQuery(ctx, dns.transport, name, dnsmessage.TypeNS, true)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return nil, 0, fmt.Errorf("dns error: %s", resp.RCode)
+	}
+
+	var nss []dnsmessage.Name
+	var ttl time.Duration
+	for _, answer := range resp.Answers {
+		if ns, ok := answer.Body.(*dnsmessage.NSResource); ok && answer.Header.Name == name {
+			nss = append(nss, ns.NS)
+			recordTTL := time.Duration(answer.Header.TTL) * time.Second
+			if len(nss) == 1 || recordTTL < ttl {
+				ttl = recordTTL
+			}
+		}
+	}
+
+	return nss, ttl, nil
+}
+
+// fqdn returns the fully qualified name of the host.
+func fqdn(host string) (dnsmessage.Name, error) {
+	return dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+}
+
+// dnsQuery sends a single question using the transport and returns the
+// response.
+func dnsQuery(ctx context.Context, transport dnsTransport, name dnsmessage.Name, qtype dnsmessage.Type, recursion bool) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	id, query, err := newDNSQuery(name, qtype, recursion)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := transport.Exchange(ctx, query)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("dns timeout: %w", err)
+		}
+		return nil, err
+	}
+
+	var resp dnsmessage.Message
+	if err := resp.Unpack(raw); err != nil {
+		return nil, fmt.Errorf("invalid dns response: %w", err)
+	}
+
+	if resp.ID != id || !resp.Response {
+		return nil, fmt.Errorf("dns response does not match the query")
+	}
+
+	return &resp, nil
+}
+
+// newDNSQuery builds a query with a random ID for a single question.
+func newDNSQuery(name dnsmessage.Name, qtype dnsmessage.Type, recursion bool) (uint16, []byte, error) {
+	id, err := newDNSID()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               id,
+			RecursionDesired: recursion,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+
+	query, err := msg.Pack()
+	return id, query, err
+}
+
+// newDNSID returns a random DNS message ID.
+func newDNSID() (uint16, error) {
+	var raw [2]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint16(raw[:]), nil
+}
+
+// answerAddr returns the address found in the answer section of the
+// response, or the zero address if the name or the record does not exist.
+func answerAddr(resp *dnsmessage.Message, t recordType) (netip.Addr, error) {
+	var addr netip.Addr
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return addr, nil
+	default:
+		return addr, fmt.Errorf("dns error: %s", resp.RCode)
+	}
+
+	var addrs []netip.Addr
+	for _, answer := range resp.Answers {
+		if a, ok := resourceAddr(answer.Body); ok && t.match(a) {
+			addrs = append(addrs, a)
+		}
+	}
+
+	switch len(addrs) {
+	case 0:
+		return addr, nil
+	case 1:
+		return addrs[0], nil
+	default:
 		return addr, fmt.Errorf("expected 1 dns address found: %v", addrs)
 	}
+}
 
-	return netip.ParseAddr(addrs[0])
+// resourceAddr returns the address of an A or AAAA record.
+func resourceAddr(body dnsmessage.ResourceBody) (netip.Addr, bool) {
+	switch body := body.(type) {
+	case *dnsmessage.AResource:
+		return netip.AddrFrom4(body.A), true
+	case *dnsmessage.AAAAResource:
+		return netip.AddrFrom16(body.AAAA).Unmap(), true
+	default:
+		return netip.Addr{}, false
+	}
 }
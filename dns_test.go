@@ -4,14 +4,27 @@ import (
 	"context"
 	"net"
 	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
 
-// testDNSServer starts a UDP DNS server that responds based on the handler.
-// The handler returns A record IPs for the query, or nil for NXDOMAIN.
-func testDNSServer(t *testing.T, handler func(name string) []netip.Addr) string {
+// testDNSMsgServer starts a UDP DNS server answering each query with the
+// message built by the handler. The ID and questions are copied from the
+// query.
+func testDNSMsgServer(t *testing.T, handler func(query dnsmessage.Message) dnsmessage.Message) string {
+	t.Helper()
+
+	return testDNSPacketServer(t, testDNSRaw(handler))
+}
+
+// testDNSPacketServer starts a UDP DNS server answering each packed query
+// with the packed response returned by the handler, if any.
+func testDNSPacketServer(t *testing.T, handler func(query []byte) []byte) string {
 	t.Helper()
 
 	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
@@ -21,62 +34,109 @@ func testDNSServer(t *testing.T, handler func(name string) []netip.Addr) string
 	t.Cleanup(func() { conn.Close() })
 
 	go func() {
-		buf := make([]byte, 512)
+		buf := make([]byte, dnsMaxMessageSize)
 		for {
 			n, addr, err := conn.ReadFrom(buf)
 			if err != nil {
 				return
 			}
 
-			var msg dnsmessage.Message
-			if err := msg.Unpack(buf[:n]); err != nil {
-				continue
+			if resp := handler(buf[:n]); resp != nil {
+				conn.WriteTo(resp, addr)
 			}
+		}
+	}()
 
-			resp := dnsmessage.Message{
-				Header: dnsmessage.Header{
-					ID:       msg.ID,
-					Response: true,
-				},
-				Questions: msg.Questions,
-			}
+	return conn.LocalAddr().String()
+}
 
-			if len(msg.Questions) > 0 {
-				name := msg.Questions[0].Name.String()
-				ips := handler(name)
-				if ips == nil {
-					resp.Header.RCode = dnsmessage.RCodeNameError
-				} else {
-					for _, ip := range ips {
-						raw := ip.As4()
-						resp.Answers = append(resp.Answers, dnsmessage.Resource{
-							Header: dnsmessage.ResourceHeader{
-								Name:  msg.Questions[0].Name,
-								Type:  dnsmessage.TypeA,
-								Class: dnsmessage.ClassINET,
-								TTL:   60,
-							},
-							Body: &dnsmessage.AResource{A: raw},
-						})
-					}
-				}
-			}
+// testDNSRaw adapts a message handler to packed messages.
+func testDNSRaw(handler func(dnsmessage.Message) dnsmessage.Message) func([]byte) []byte {
+	return func(raw []byte) []byte {
+		var query dnsmessage.Message
+		if err := query.Unpack(raw); err != nil {
+			return nil
+		}
 
-			packed, err := resp.Pack()
-			if err != nil {
+		packed, err := testDNSAnswer(query, handler)
+		if err != nil {
+			return nil
+		}
+
+		return packed
+	}
+}
+
+// testDNSAnswer returns the packed response built by the handler for the
+// query.
+func testDNSAnswer(query dnsmessage.Message, handler func(dnsmessage.Message) dnsmessage.Message) ([]byte, error) {
+	resp := handler(query)
+	resp.ID = query.ID
+	resp.Response = true
+	resp.Questions = query.Questions
+	return resp.Pack()
+}
+
+// testDNSServer starts a UDP DNS server that responds based on the handler.
+// The handler returns the IPs for the query, or nil for NXDOMAIN. Only the IPs
+// matching the question type are answered, as A or AAAA records. TXT questions
+// are answered with every IP as text.
+func testDNSServer(t *testing.T, handler func(name string) []netip.Addr) string {
+	t.Helper()
+
+	return testDNSMsgServer(t, testDNSHandler(handler))
+}
+
+// testDNSHandler builds the responses of testDNSServer.
+func testDNSHandler(handler func(name string) []netip.Addr) func(dnsmessage.Message) dnsmessage.Message {
+	return func(msg dnsmessage.Message) dnsmessage.Message {
+		resp := dnsmessage.Message{
+			Header: dnsmessage.Header{Authoritative: true},
+		}
+
+		if len(msg.Questions) == 0 {
+			return resp
+		}
+
+		ips := handler(msg.Questions[0].Name.String())
+		if ips == nil {
+			resp.Header.RCode = dnsmessage.RCodeNameError
+			return resp
+		}
+
+		for _, ip := range ips {
+			var body dnsmessage.ResourceBody
+			switch {
+			case ip.Is4() && msg.Questions[0].Type == dnsmessage.TypeA:
+				body = &dnsmessage.AResource{A: ip.As4()}
+			case ip.Is6() && msg.Questions[0].Type == dnsmessage.TypeAAAA:
+				body = &dnsmessage.AAAAResource{AAAA: ip.As16()}
+			case msg.Questions[0].Type == dnsmessage.TypeTXT:
+				body = &dnsmessage.TXTResource{TXT: []string{ip.String()}}
+			default:
 				continue
 			}
-			conn.WriteTo(packed, addr)
+
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{
+					Name:  msg.Questions[0].Name,
+					Type:  msg.Questions[0].Type,
+					Class: dnsmessage.ClassINET,
+					TTL:   60,
+				},
+				Body: body,
+			})
 		}
-	}()
 
-	return conn.LocalAddr().String()
+		return resp
+	}
 }
 
 func TestDNSProviderLookup(t *testing.T) {
 	tests := []struct {
 		name     string
 		host     string
+		rt       recordType
 		ips      []netip.Addr // nil = NXDOMAIN
 		wantAddr netip.Addr
 		wantErr  bool
@@ -87,6 +147,19 @@ func TestDNSProviderLookup(t *testing.T) {
 			ips:      []netip.Addr{netip.MustParseAddr("203.0.113.1")},
 			wantAddr: netip.MustParseAddr("203.0.113.1"),
 		},
+		{
+			name:     "single AAAA record",
+			host:     "example.com.",
+			rt:       recordTypeAAAA,
+			ips:      []netip.Addr{netip.MustParseAddr("203.0.113.1"), netip.MustParseAddr("2001:db8::1")},
+			wantAddr: netip.MustParseAddr("2001:db8::1"),
+		},
+		{
+			name: "no AAAA record",
+			host: "example.com.",
+			rt:   recordTypeAAAA,
+			ips:  []netip.Addr{netip.MustParseAddr("203.0.113.1")},
+		},
 		{
 			name: "not found",
 			host: "missing.example.com.",
@@ -108,8 +181,128 @@ func TestDNSProviderLookup(t *testing.T) {
 				return nil
 			})
 
-			dns := newDNSProvider(addr)
-			got, err := dns.Lookup(context.Background(), tc.host)
+			rt := tc.rt
+			if rt == "" {
+				rt = recordTypeA
+			}
+
+			dns, err := newDNSProvider(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := dns.Lookup(context.Background(), tc.host, rt)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.wantAddr {
+				t.Fatalf("got %v, want %v", got, tc.wantAddr)
+			}
+		})
+	}
+}
+
+func TestDNSProviderLookupAuthoritative(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+	staleIP := netip.MustParseAddr("198.51.100.1")
+
+	// The resolver knows the nameserver of the zone but serves a stale
+	// answer for the host.
+	resolver := testDNSMsgServer(t, func(query dnsmessage.Message) dnsmessage.Message {
+		q := query.Questions[0]
+		resp := dnsmessage.Message{Header: dnsmessage.Header{RecursionAvailable: true}}
+		switch {
+		case q.Name.String() == "example.com." && q.Type == dnsmessage.TypeNS:
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+				Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns1.example.com.")},
+			})
+		case q.Name.String() == "ns1.example.com." && q.Type == dnsmessage.TypeA:
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+			})
+		case q.Name.String() == "home.example.com." && q.Type == dnsmessage.TypeA:
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+				Body:   &dnsmessage.AResource{A: staleIP.As4()},
+			})
+		case q.Name.String() == "example.com." || q.Name.String() == "ns1.example.com.":
+			// No data
+			resp.Authoritative = true
+		default:
+			resp.RCode = dnsmessage.RCodeNameError
+		}
+		return resp
+	})
+
+	tests := []struct {
+		name          string
+		host          string
+		authoritative bool
+		wantAddr      netip.Addr
+		wantErr       bool
+	}{
+		{
+			name:          "authoritative answer",
+			host:          "home.example.com.",
+			authoritative: true,
+			wantAddr:      ip,
+		},
+		{
+			name:          "authoritative not found",
+			host:          "missing.example.com.",
+			authoritative: true,
+		},
+		{
+			name:    "non authoritative answer",
+			host:    "home.example.com.",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var recursionDesired atomic.Bool
+			ns := testDNSMsgServer(t, func(query dnsmessage.Message) dnsmessage.Message {
+				recursionDesired.Store(query.RecursionDesired)
+				resp := dnsmessage.Message{Header: dnsmessage.Header{Authoritative: tc.authoritative}}
+
+				q := query.Questions[0]
+				if q.Name.String() != "home.example.com." {
+					resp.RCode = dnsmessage.RCodeNameError
+					return resp
+				}
+
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+					Body:   &dnsmessage.AResource{A: ip.As4()},
+				})
+				return resp
+			})
+			_, port, _ := net.SplitHostPort(ns)
+
+			dns, err := newDNSProvider(resolver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dns.authoritative = true
+			dns.nsPort = port
+
+			got, err := dns.Lookup(context.Background(), tc.host, recordTypeA)
+
+			if recursionDesired.Load() {
+				t.Fatal("expected recursion to be disabled")
+			}
 
 			if tc.wantErr {
 				if err == nil {
@@ -128,3 +321,90 @@ func TestDNSProviderLookup(t *testing.T) {
 		})
 	}
 }
+
+func TestDNSProviderNameserverCache(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	resolver := testDNSMsgServer(t, func(query dnsmessage.Message) dnsmessage.Message {
+		q := query.Questions[0]
+		mu.Lock()
+		queries = append(queries, q.Type.String()+" "+q.Name.String())
+		mu.Unlock()
+
+		resp := dnsmessage.Message{Header: dnsmessage.Header{RecursionAvailable: true}}
+		switch {
+		case q.Name.String() == "example.com." && q.Type == dnsmessage.TypeNS:
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 3600},
+				Body:   &dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns1.example.com.")},
+			})
+		case q.Name.String() == "ns1.example.com." && q.Type == dnsmessage.TypeA:
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+			})
+		case q.Name.String() == "example.com." || q.Name.String() == "ns1.example.com.":
+			// No data
+		default:
+			resp.RCode = dnsmessage.RCodeNameError
+		}
+		return resp
+	})
+
+	ns := testDNSMsgServer(t, func(query dnsmessage.Message) dnsmessage.Message {
+		return dnsmessage.Message{Header: dnsmessage.Header{Authoritative: true}}
+	})
+	_, port, _ := net.SplitHostPort(ns)
+
+	now := time.Unix(1700000000, 0)
+	dns, err := newDNSProvider(resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns.authoritative = true
+	dns.nsPort = port
+	dns.clock = func() time.Time { return now }
+
+	// The nameservers of the zone are resolved once for their lowest TTL,
+	// the names without nameservers for nsNegativeTTL.
+	steps := []struct {
+		host    string
+		advance time.Duration
+		want    []string
+	}{
+		{
+			host: "home.example.com",
+			want: []string{"TypeNS home.example.com.", "TypeNS example.com.", "TypeA ns1.example.com.", "TypeAAAA ns1.example.com."},
+		},
+		{
+			host: "nas.example.com",
+			want: []string{"TypeNS nas.example.com."},
+		},
+		{
+			host: "home.example.com",
+		},
+		{
+			host:    "home.example.com",
+			advance: time.Minute,
+			want:    []string{"TypeNS example.com.", "TypeA ns1.example.com.", "TypeAAAA ns1.example.com."},
+		},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		mu.Lock()
+		queries = nil
+		mu.Unlock()
+
+		if _, err := dns.Lookup(context.Background(), step.host, recordTypeA); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		got := queries
+		mu.Unlock()
+		if !slices.Equal(got, step.want) {
+			t.Fatalf("lookup of %s: got queries %v, want %v", step.host, got, step.want)
+		}
+	}
+}
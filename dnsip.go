@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// dnsIPProvider learns the public IP using a DNS query to a server echoing the
+// address of the client. It is configured as dns://SERVER[:PORT]/NAME and
+// queries the A or AAAA record of NAME, e.g.
+// dns://resolver1.opendns.com/myip.opendns.com. Adding ?type=TXT queries the
+// TXT record instead, e.g. dns://ns1.google.com/o-o.myaddr.l.google.com?type=TXT.
+type dnsIPProvider struct{}
+
+func newDNSIPProvider() *dnsIPProvider {
+	return &dnsIPProvider{}
+}
+
+func (p *dnsIPProvider) Get(ctx context.Context, provider ipSource, t recordType) (netip.Addr, error) {
+	var addr netip.Addr
+	u, err := url.Parse(provider.URL)
+	if err != nil {
+		return addr, err
+	}
+
+	name := strings.Trim(u.Path, "/")
+	if u.Hostname() == "" || name == "" {
+		return addr, fmt.Errorf("expected dns://SERVER/NAME, got %q", provider.URL)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "53"
+	}
+
+	// Query the server over the requested IP family so it echoes the
+	// address of that family.
+	network := "udp4"
+	if t == recordTypeAAAA {
+		network = "udp6"
+	}
+	resolver := newResolver(network, net.JoinHostPort(u.Hostname(), port))
+
+	var candidates []string
+	switch qtype := strings.ToUpper(u.Query().Get("type")); qtype {
+	case "":
+		addrs, err := resolver.LookupNetIP(ctx, t.network(), name)
+		if err != nil {
+			return addr, err
+		}
+		for _, a := range addrs {
+			candidates = append(candidates, a.String())
+		}
+	case "TXT":
+		candidates, err = resolver.LookupTXT(ctx, name)
+		if err != nil {
+			return addr, err
+		}
+	default:
+		return addr, fmt.Errorf("unsupported query type %q", qtype)
+	}
+
+	for _, candidate := range candidates {
+		a, err := netip.ParseAddr(strings.TrimSpace(candidate))
+		if err != nil {
+			continue
+		}
+
+		if a = a.Unmap(); t.match(a) {
+			return a, nil
+		}
+	}
+
+	return addr, fmt.Errorf("no %s address in the answer for %s: %v", t, name, candidates)
+}
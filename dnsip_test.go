@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+)
+
+func TestDNSIPProviderGet(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+
+	tests := []struct {
+		name     string
+		path     string
+		ips      []netip.Addr // nil = NXDOMAIN
+		wantAddr netip.Addr
+		wantErr  bool
+	}{
+		{
+			name:     "A record",
+			path:     "/myip.opendns.com",
+			ips:      []netip.Addr{ip},
+			wantAddr: ip,
+		},
+		{
+			name:     "TXT record",
+			path:     "/o-o.myaddr.l.google.com?type=TXT",
+			ips:      []netip.Addr{ip},
+			wantAddr: ip,
+		},
+		{
+			name:    "TXT record of another family",
+			path:    "/o-o.myaddr.l.google.com?type=txt",
+			ips:     []netip.Addr{netip.MustParseAddr("2001:db8::1")},
+			wantErr: true,
+		},
+		{
+			name:    "not found",
+			path:    "/myip.opendns.com",
+			wantErr: true,
+		},
+		{
+			name:    "missing name",
+			path:    "/",
+			ips:     []netip.Addr{ip},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported query type",
+			path:    "/myip.opendns.com?type=MX",
+			ips:     []netip.Addr{ip},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := testDNSServer(t, func(name string) []netip.Addr {
+				if name == "myip.opendns.com." || name == "o-o.myaddr.l.google.com." {
+					return tc.ips
+				}
+				return nil
+			})
+
+			p := newDNSIPProvider()
+			got, err := p.Get(context.Background(), ipSource{URL: "dns://" + addr + tc.path}, recordTypeA)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.wantAddr {
+				t.Fatalf("got %v, want %v", got, tc.wantAddr)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// dnsMaxMessageSize is the maximum size of a DNS message.
+const dnsMaxMessageSize = 65535
+
+// dnsTransport sends a packed DNS query to a server and returns the packed
+// response.
+type dnsTransport interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// newDNSTransport returns the transport matching the provider, either a
+// plain host[:port] queried over UDP, or an URL:
+//   - udp://HOST[:PORT] and tcp://HOST[:PORT], port 53 by default.
+//   - tls://HOST[:PORT] for DNS over TLS (RFC 7858), port 853 by default.
+//   - https://HOST/PATH for DNS over HTTPS (RFC 8484).
+func newDNSTransport(provider string) (dnsTransport, error) {
+	if !strings.Contains(provider, "://") {
+		return &udpTransport{server: withDefaultPort(provider, "53")}, nil
+	}
+
+	u, err := url.Parse(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing DNS server in %q", provider)
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return &udpTransport{server: withDefaultPort(u.Host, "53")}, nil
+	case "tcp":
+		return &streamTransport{server: withDefaultPort(u.Host, "53")}, nil
+	case "tls":
+		return &streamTransport{
+			server:    withDefaultPort(u.Host, "853"),
+			tlsConfig: &tls.Config{ServerName: u.Hostname()},
+		}, nil
+	case "https":
+		return &httpsTransport{url: provider, client: http.DefaultClient}, nil
+	default:
+		return nil, fmt.Errorf("unsupported DNS provider scheme %q", u.Scheme)
+	}
+}
+
+// withDefaultPort adds the port to the host if it has none.
+func withDefaultPort(host, port string) string {
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return net.JoinHostPort(addr.String(), port)
+	}
+
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// udpTransport sends the queries over UDP, retrying over TCP if the response
+// is truncated.
+type udpTransport struct {
+	server string
+}
+
+func (t *udpTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", t.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, dnsMaxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// Ignore the datagrams not answering our query
+		if n < 12 || !bytes.Equal(buf[:2], query[:2]) {
+			continue
+		}
+
+		if truncated := buf[2]&0x02 != 0; truncated {
+			tcp := &streamTransport{server: t.server}
+			return tcp.Exchange(ctx, query)
+		}
+
+		return buf[:n], nil
+	}
+}
+
+// streamTransport sends the queries over TCP, or over TLS if configured,
+// each message being prefixed by its length.
+type streamTransport struct {
+	server    string
+	tlsConfig *tls.Config
+}
+
+func (t *streamTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if t.tlsConfig != nil {
+		d := tls.Dialer{Config: t.tlsConfig}
+		conn, err = d.DialContext(ctx, "tcp", t.server)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", t.server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// httpsTransport sends the queries using DNS over HTTPS POST requests.
+type httpsTransport struct {
+	url    string
+	client *http.Client
+}
+
+func (t *httpsTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", t.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid response from server: %s", resp.Status)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/dns-message" {
+		return nil, fmt.Errorf("invalid content type from server: %q", ct)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, dnsMaxMessageSize))
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testDNSStreamServer serves DNS queries on the listener, each message being
+// prefixed by its length as done over TCP and TLS. The handler returns the
+// packed response to each packed query.
+func testDNSStreamServer(t *testing.T, ln net.Listener, handler func(query []byte) []byte) string {
+	t.Helper()
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+
+				raw := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, raw); err != nil {
+					return
+				}
+
+				packed := handler(raw)
+				if packed == nil {
+					return
+				}
+
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...))
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestNewDNSTransport(t *testing.T) {
+	tests := []struct {
+		provider   string
+		wantServer string
+		wantTLS    bool
+		wantURL    string
+		wantErr    bool
+	}{
+		{provider: "1.1.1.1", wantServer: "1.1.1.1:53"},
+		{provider: "1.1.1.1:5353", wantServer: "1.1.1.1:5353"},
+		{provider: "2606:4700:4700::1111", wantServer: "[2606:4700:4700::1111]:53"},
+		{provider: "udp://1.1.1.1", wantServer: "1.1.1.1:53"},
+		{provider: "tcp://[2606:4700:4700::1111]", wantServer: "[2606:4700:4700::1111]:53"},
+		{provider: "tcp://1.1.1.1:5353", wantServer: "1.1.1.1:5353"},
+		{provider: "tls://one.one.one.one", wantServer: "one.one.one.one:853", wantTLS: true},
+		{provider: "https://dns.example/dns-query", wantURL: "https://dns.example/dns-query"},
+		{provider: "quic://1.1.1.1", wantErr: true},
+		{provider: "tls://", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.provider, func(t *testing.T) {
+			transport, err := newDNSTransport(tc.provider)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			switch tr := transport.(type) {
+			case *udpTransport:
+				if tr.server != tc.wantServer || tc.wantTLS {
+					t.Fatalf("got UDP transport to %s, want %s", tr.server, tc.wantServer)
+				}
+			case *streamTransport:
+				if tr.server != tc.wantServer || (tr.tlsConfig != nil) != tc.wantTLS {
+					t.Fatalf("got stream transport to %s (TLS: %v), want %s (TLS: %v)",
+						tr.server, tr.tlsConfig != nil, tc.wantServer, tc.wantTLS)
+				}
+			case *httpsTransport:
+				if tr.url != tc.wantURL {
+					t.Fatalf("got HTTPS transport to %s, want %s", tr.url, tc.wantURL)
+				}
+			default:
+				t.Fatalf("unexpected transport %T", transport)
+			}
+		})
+	}
+}
+
+func TestDNSProviderTransports(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+	handler := testDNSHandler(func(name string) []netip.Addr {
+		if name == "home.example.com." {
+			return []netip.Addr{ip}
+		}
+		return nil
+	})
+
+	// The DoH server certificate is also used by the DoT server
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		raw, _ := io.ReadAll(r.Body)
+		var query dnsmessage.Message
+		if err := query.Unpack(raw); err != nil {
+			http.Error(w, "invalid query", http.StatusBadRequest)
+			return
+		}
+
+		packed, err := testDNSAnswer(query, handler)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	t.Cleanup(doh.Close)
+	rootCAs := doh.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	tests := []struct {
+		name      string
+		transport func(t *testing.T) dnsTransport
+	}{
+		{
+			name: "tcp",
+			transport: func(t *testing.T) dnsTransport {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return &streamTransport{server: testDNSStreamServer(t, ln, testDNSRaw(handler))}
+			},
+		},
+		{
+			name: "tls",
+			transport: func(t *testing.T) dnsTransport {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				ln = tls.NewListener(ln, &tls.Config{Certificates: doh.TLS.Certificates})
+				return &streamTransport{
+					server:    testDNSStreamServer(t, ln, testDNSRaw(handler)),
+					tlsConfig: &tls.Config{ServerName: "127.0.0.1", RootCAs: rootCAs},
+				}
+			},
+		},
+		{
+			name: "https",
+			transport: func(t *testing.T) dnsTransport {
+				return &httpsTransport{url: doh.URL + "/dns-query", client: doh.Client()}
+			},
+		},
+		{
+			name: "udp truncated, retry over tcp",
+			transport: func(t *testing.T) dnsTransport {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				server := testDNSStreamServer(t, ln, testDNSRaw(handler))
+
+				conn, err := net.ListenPacket("udp", server)
+				if err != nil {
+					t.Skipf("failed to listen on %s: %v", server, err)
+				}
+				t.Cleanup(func() { conn.Close() })
+
+				truncated := testDNSRaw(func(dnsmessage.Message) dnsmessage.Message {
+					return dnsmessage.Message{Header: dnsmessage.Header{Truncated: true}}
+				})
+
+				go func() {
+					buf := make([]byte, 512)
+					for {
+						n, addr, err := conn.ReadFrom(buf)
+						if err != nil {
+							return
+						}
+						conn.WriteTo(truncated(buf[:n]), addr)
+					}
+				}()
+
+				return &udpTransport{server: server}
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dns := &dnsProvider{transport: tc.transport(t)}
+
+			got, err := dns.Lookup(context.Background(), "home.example.com", recordTypeA)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != ip {
+				t.Fatalf("got %v, want %v", got, ip)
+			}
+
+			got, err = dns.Lookup(context.Background(), "missing.example.com", recordTypeA)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got.IsValid() {
+				t.Fatalf("got %v, want no address", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	dyndns2Timeout     = 30 * time.Second
+	dyndns2MaxBodySize = 1024
+	dyndns2UserAgent   = "waybackd"
+)
+
+// errDynDNS2Fatal is returned once the server asked to stop sending updates
+// for a hostname, until its configuration is fixed.
+var errDynDNS2Fatal = errors.New("dyndns2 updates disabled")
+
+// dyndns2Errors describes the error codes of the dyndns2 protocol.
+var dyndns2Errors = map[string]string{
+	"badauth":  "invalid username or password",
+	"abuse":    "hostname blocked for abuse",
+	"nohost":   "hostname does not exist or is not allowed for this account",
+	"notfqdn":  "hostname is not a fully qualified domain name",
+	"!yours":   "hostname does not belong to this account",
+	"numhost":  "too many hostnames in the update",
+	"badagent": "user agent blocked",
+	"dnserr":   "server side DNS error",
+	"911":      "server side error",
+}
+
+// dyndns2Fatal lists the error codes after which the updates of the
+// hostname are disabled, retrying would only get the account blocked.
+var dyndns2Fatal = map[string]bool{
+	"badauth": true,
+	"abuse":   true,
+}
+
+type dyndns2Config struct {
+	// URL is the update endpoint, e.g. https://www.ovh.com/nic/update.
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// merge returns the configuration overridden by the non empty fields of
+// other.
+func (c dyndns2Config) merge(other dyndns2Config) dyndns2Config {
+	if other.URL != "" {
+		c.URL = other.URL
+	}
+	if other.Username != "" {
+		c.Username = other.Username
+	}
+	if other.Password != "" {
+		c.Password = other.Password
+	}
+
+	return c
+}
+
+func (c dyndns2Config) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid dyndns2 url: %w", err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid dyndns2 url %q", c.URL)
+	}
+
+	if c.Username == "" {
+		return fmt.Errorf("missing dyndns2 username")
+	}
+
+	return nil
+}
+
+// dyndns2Backend pushes the records to an endpoint speaking the dyndns2
+// protocol, such as OVH DynHost or No-IP. The protocol cannot read the
+// records, the last target pushed is remembered instead.
+type dyndns2Backend struct {
+	client *http.Client
+	config dyndns2Config
+
+	mu sync.Mutex
+	// targets holds the last target pushed, keyed by hostname and type.
+	targets map[string]string
+	// fatal holds the error disabling the updates of a hostname.
+	fatal map[string]dyndns2Disabled
+}
+
+// dyndns2Disabled is the error disabling the updates of a hostname, until
+// the configuration refused by the server changes.
+type dyndns2Disabled struct {
+	err    error
+	config dyndns2Config
+}
+
+func newDynDNS2Backend(cfg dyndns2Config) *dyndns2Backend {
+	return &dyndns2Backend{
+		client:  &http.Client{Timeout: dyndns2Timeout},
+		config:  cfg,
+		targets: map[string]string{},
+		fatal:   map[string]dyndns2Disabled{},
+	}
+}
+
+// keep carries the state of the backend replaced on reload: the targets
+// pushed, and the hostnames of the domains still disabled, their
+// configuration being unchanged.
+func (b *dyndns2Backend) keep(old *dyndns2Backend, domains []domain) {
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	maps.Copy(b.targets, old.targets)
+	for _, d := range domains {
+		disabled, ok := old.fatal[d.hostname()]
+		if ok && disabled.config == b.config.merge(d.DynDNS2) {
+			b.fatal[d.hostname()] = disabled
+		}
+	}
+}
+
+func dyndns2Key(d domain, t recordType) string {
+	return d.hostname() + "/" + string(t)
+}
+
+// Find returns the last record pushed since the start of the daemon, if any.
+func (b *dyndns2Backend) Find(_ context.Context, d domain, t recordType) (*record, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if disabled, ok := b.fatal[d.hostname()]; ok {
+		return nil, disabled.err
+	}
+
+	target, ok := b.targets[dyndns2Key(d, t)]
+	if !ok {
+		return nil, nil
+	}
+
+	return &record{Type: t, Target: target, TTL: d.TTL}, nil
+}
+
+func (b *dyndns2Backend) Create(ctx context.Context, d domain, r record) error {
+	return b.push(ctx, d, r)
+}
+
+func (b *dyndns2Backend) Update(ctx context.Context, d domain, r record) error {
+	return b.push(ctx, d, r)
+}
+
+func (b *dyndns2Backend) Delete(context.Context, domain, record) error {
+	return fmt.Errorf("deleting records is not supported by the dyndns2 protocol")
+}
+
+// Refresh does nothing, the updates are applied by the server.
+func (b *dyndns2Backend) Refresh(context.Context, string) error {
+	return nil
+}
+
+// push sends the target of the record to the update endpoint.
+func (b *dyndns2Backend) push(ctx context.Context, d domain, r record) error {
+	b.mu.Lock()
+	disabled, ok := b.fatal[d.hostname()]
+	b.mu.Unlock()
+	if ok {
+		return disabled.err
+	}
+
+	cfg := b.config.merge(d.DynDNS2)
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return err
+	}
+
+	v := u.Query()
+	v.Set("hostname", d.hostname())
+	v.Set("myip", r.Target)
+	u.RawQuery = v.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(cfg.Username, cfg.Password)
+	req.Header.Set("User-Agent", dyndns2UserAgent)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to update the record: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dyndns2MaxBodySize))
+	if err != nil {
+		return fmt.Errorf("failed to read the update response: %w", err)
+	}
+
+	code := parseDynDNS2Response(body)
+	if code == "" && resp.StatusCode == http.StatusUnauthorized {
+		code = "badauth"
+	}
+
+	switch code {
+	case "good", "nochg":
+		b.mu.Lock()
+		b.targets[dyndns2Key(d, r.Type)] = r.Target
+		b.mu.Unlock()
+		return nil
+	case "":
+		return fmt.Errorf("unexpected dyndns2 response %q: %s", bytes.TrimSpace(body), resp.Status)
+	}
+
+	err = fmt.Errorf("update refused: %s: %s", code, dyndns2Errors[code])
+
+	if dyndns2Fatal[code] {
+		err = permanent(fmt.Errorf("%w: %w", errDynDNS2Fatal, err))
+		b.mu.Lock()
+		b.fatal[d.hostname()] = dyndns2Disabled{err: err, config: cfg}
+		b.mu.Unlock()
+	}
+
+	return err
+}
+
+// parseDynDNS2Response returns the code of the first line of the response,
+// e.g. good in "good 203.0.113.1".
+func parseDynDNS2Response(body []byte) string {
+	line, _, _ := bytes.Cut(bytes.TrimSpace(body), []byte("\n"))
+	code, _, _ := bytes.Cut(bytes.TrimSpace(line), []byte(" "))
+	code = bytes.TrimSpace(code)
+
+	if _, ok := dyndns2Errors[string(code)]; ok {
+		return string(code)
+	}
+
+	switch string(code) {
+	case "good", "nochg":
+		return string(code)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestDynDNS2Backend(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+	d := domain{
+		Domain:    "example.com",
+		SubDomain: "home",
+		DynDNS2:   dyndns2Config{Username: "example.com-home"},
+	}
+
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantErr    bool
+		wantFatal  bool
+		wantTarget string
+	}{
+		{
+			name:       "good",
+			body:       "good 203.0.113.1",
+			wantTarget: "203.0.113.1",
+		},
+		{
+			name:       "nochg",
+			body:       "nochg 203.0.113.1\n",
+			wantTarget: "203.0.113.1",
+		},
+		{
+			name:    "nohost",
+			body:    "nohost",
+			wantErr: true,
+		},
+		{
+			name:    "server error",
+			body:    "911",
+			wantErr: true,
+		},
+		{
+			name:    "unexpected response",
+			status:  http.StatusInternalServerError,
+			body:    "<html>oops</html>",
+			wantErr: true,
+		},
+		{
+			name:      "badauth",
+			body:      "badauth",
+			wantErr:   true,
+			wantFatal: true,
+		},
+		{
+			name:      "unauthorized",
+			status:    http.StatusUnauthorized,
+			wantErr:   true,
+			wantFatal: true,
+		},
+		{
+			name:      "abuse",
+			body:      "abuse",
+			wantErr:   true,
+			wantFatal: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+
+				user, pass, ok := r.BasicAuth()
+				if !ok || user != "example.com-home" || pass != "secret" {
+					t.Errorf("unexpected credentials %q:%q", user, pass)
+				}
+
+				q := r.URL.Query()
+				if q.Get("system") != "dyndns" || q.Get("hostname") != "home.example.com" || q.Get("myip") != ip.String() {
+					t.Errorf("unexpected query %s", r.URL.RawQuery)
+				}
+
+				if tc.status != 0 {
+					w.WriteHeader(tc.status)
+				}
+				fmt.Fprint(w, tc.body)
+			}))
+			defer server.Close()
+
+			b := newDynDNS2Backend(dyndns2Config{
+				URL:      server.URL + "/nic/update?system=dyndns",
+				Username: "default",
+				Password: "secret",
+			})
+			a := &app{backends: map[string]DNSBackend{defaultBackend: b}}
+
+			err := updateRecord(a, d, ip)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// Fatal errors disable the updates without calling the server
+			// again, the others are retried.
+			err = updateRecord(a, d, ip)
+			if got := errors.Is(err, errDynDNS2Fatal); got != tc.wantFatal {
+				t.Fatalf("got fatal %v, want %v: %v", got, tc.wantFatal, err)
+			}
+
+			wantCalls := 2
+			if tc.wantFatal || tc.wantTarget != "" {
+				wantCalls = 1
+			}
+			if calls != wantCalls {
+				t.Fatalf("got %d calls, want %d", calls, wantCalls)
+			}
+
+			r, err := b.Find(context.Background(), d, recordTypeA)
+			if tc.wantFatal {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+
+			var target string
+			if r != nil {
+				target = r.Target
+			}
+			if target != tc.wantTarget {
+				t.Fatalf("got target %q, want %q", target, tc.wantTarget)
+			}
+		})
+	}
+}
+
+func TestDynDNS2ConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		global  dyndns2Config
+		domain  dyndns2Config
+		wantErr bool
+	}{
+		{
+			name:   "global config",
+			global: dyndns2Config{URL: "https://dynupdate.no-ip.com/nic/update", Username: "user"},
+		},
+		{
+			name:   "domain credentials",
+			global: dyndns2Config{URL: "https://www.ovh.com/nic/update"},
+			domain: dyndns2Config{Username: "example.com-home", Password: "secret"},
+		},
+		{
+			name:    "missing url",
+			domain:  dyndns2Config{Username: "user"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid url",
+			global:  dyndns2Config{URL: "ftp://example.com", Username: "user"},
+			wantErr: true,
+		},
+		{
+			name:    "missing username",
+			global:  dyndns2Config{URL: "https://www.ovh.com/nic/update"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.global.merge(tc.domain).validate()
+
+			if tc.wantErr && err == nil {
+				t.Fatal("expected error, got nil")
+			}
+
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
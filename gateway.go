@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Gateway protocol constants, from RFC 6886 (NAT-PMP) and RFC 6887 (PCP).
+const (
+	gatewayPort            = "5351"
+	natpmpVersion          = 0
+	natpmpOpExternalAddr   = 0
+	natpmpResponseSize     = 12
+	pcpVersion             = 2
+	pcpOpMap               = 1
+	pcpResponseBit         = 0x80
+	pcpMapSize             = 60
+	pcpProtocolUDP         = 17
+	pcpMapLifetime         = 30
+	ssdpMulticastAddr      = "239.255.255.250:1900"
+	ssdpSearchTarget       = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	upnpWANIPConnection    = "urn:schemas-upnp-org:service:WANIPConnection:"
+	upnpWANPPPConnection   = "urn:schemas-upnp-org:service:WANPPPConnection:"
+	gatewayTimeout         = 2 * time.Second
+	upnpDescriptionMaxSize = 1 << 20
+)
+
+// cgnatPrefix is the shared address space used by carrier-grade NATs, as
+// defined in RFC 6598.
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// gatewayProvider asks the local router for its WAN address. The following
+// schemes are supported:
+//   - upnp:// discovers an Internet Gateway Device using SSDP and calls
+//     GetExternalIPAddress, upnp://HOST:PORT/PATH skips the discovery and
+//     uses the given device description URL.
+//   - natpmp:// sends a NAT-PMP external address request.
+//   - pcp:// sends a short-lived PCP MAP request and reads the assigned
+//     external address.
+//
+// The NAT-PMP and PCP requests are sent to the default gateway unless a host
+// is given, e.g. natpmp://192.168.1.1.
+type gatewayProvider struct {
+	client *http.Client
+	// ssdpAddr is the address where the SSDP search is sent.
+	ssdpAddr string
+	// defaultGateway returns the IPv4 default gateway.
+	defaultGateway func() (netip.Addr, error)
+}
+
+func newGatewayProvider() *gatewayProvider {
+	return &gatewayProvider{
+		client:         &http.Client{Timeout: gatewayTimeout},
+		ssdpAddr:       ssdpMulticastAddr,
+		defaultGateway: defaultGateway,
+	}
+}
+
+func (p *gatewayProvider) Get(ctx context.Context, provider ipSource, t recordType) (netip.Addr, error) {
+	var addr netip.Addr
+	u, err := url.Parse(provider.URL)
+	if err != nil {
+		return addr, err
+	}
+
+	if t != recordTypeA {
+		return addr, fmt.Errorf("%s only supports A records", u.Scheme)
+	}
+
+	switch u.Scheme {
+	case "upnp":
+		addr, err = p.getUPnP(ctx, u)
+	case "natpmp":
+		addr, err = p.getNATPMP(ctx, u)
+	case "pcp":
+		addr, err = p.getPCP(ctx, u)
+	default:
+		err = fmt.Errorf("unsupported gateway protocol %q", u.Scheme)
+	}
+	if err != nil {
+		return addr, err
+	}
+
+	addr = addr.Unmap()
+	if !t.match(addr) {
+		return addr, fmt.Errorf("got invalid address %s from the gateway", addr)
+	}
+
+	if err := checkPublicAddr(addr); err != nil {
+		return addr, err
+	}
+
+	return addr, nil
+}
+
+// checkPublicAddr returns an error if the WAN address of the router is not
+// reachable from the internet, meaning there is another NAT upstream.
+func checkPublicAddr(addr netip.Addr) error {
+	switch {
+	case cgnatPrefix.Contains(addr):
+		return fmt.Errorf("gateway reported the CGNAT address %s, the router is behind a carrier-grade NAT", addr)
+	case addr.IsPrivate():
+		return fmt.Errorf("gateway reported the private address %s, the router is behind another NAT", addr)
+	case !addr.IsGlobalUnicast():
+		return fmt.Errorf("gateway reported the non routable address %s", addr)
+	}
+
+	return nil
+}
+
+// gatewayAddr returns the address of the gateway to query using NAT-PMP or
+// PCP.
+func (p *gatewayProvider) gatewayAddr(u *url.URL) (string, error) {
+	host := u.Hostname()
+	if host == "" {
+		gw, err := p.defaultGateway()
+		if err != nil {
+			return "", fmt.Errorf("failed to find the default gateway: %w", err)
+		}
+		host = gw.String()
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = gatewayPort
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// gatewayExchange sends the request built for the local address over UDP and
+// returns the first response accepted by the check function.
+func gatewayExchange(ctx context.Context, address string, build func(local netip.Addr) []byte, check func([]byte) bool) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, gatewayTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	local := conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr()
+	if _, err := conn.Write(build(local)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1100)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if check(buf[:n]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+func (p *gatewayProvider) getNATPMP(ctx context.Context, u *url.URL) (netip.Addr, error) {
+	address, err := p.gatewayAddr(u)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	req := func(netip.Addr) []byte {
+		return []byte{natpmpVersion, natpmpOpExternalAddr}
+	}
+	check := func(resp []byte) bool {
+		return len(resp) >= natpmpResponseSize &&
+			resp[0] == natpmpVersion &&
+			resp[1] == natpmpOpExternalAddr|0x80
+	}
+
+	resp, err := gatewayExchange(ctx, address, req, check)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("NAT-PMP request failed: %w", err)
+	}
+
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != 0 {
+		return netip.Addr{}, fmt.Errorf("NAT-PMP request failed with result code %d", code)
+	}
+
+	return netip.AddrFrom4([4]byte(resp[8:12])), nil
+}
+
+// newPCPMapRequest builds a PCP MAP request for a UDP mapping of the given
+// port with the given lifetime, a zero lifetime deleting the mapping.
+func newPCPMapRequest(local netip.Addr, nonce [12]byte, port uint16, lifetime uint32) []byte {
+	req := make([]byte, pcpMapSize)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:8], lifetime)
+	clientIP := netip.AddrFrom16(local.As16()).As16()
+	copy(req[8:24], clientIP[:])
+
+	copy(req[24:36], nonce[:])
+	req[36] = pcpProtocolUDP
+	binary.BigEndian.PutUint16(req[40:42], port)
+	// Suggest any IPv4 external address
+	anyIPv4 := netip.AddrFrom16(netip.IPv4Unspecified().As16()).As16()
+	copy(req[44:60], anyIPv4[:])
+	return req
+}
+
+func (p *gatewayProvider) getPCP(ctx context.Context, u *url.URL) (netip.Addr, error) {
+	address, err := p.gatewayAddr(u)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	var nonce [12]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return netip.Addr{}, err
+	}
+
+	// The mapped port does not matter, it is only used to learn the
+	// external address.
+	var port [2]byte
+	if _, err := rand.Read(port[:]); err != nil {
+		return netip.Addr{}, err
+	}
+	internalPort := binary.BigEndian.Uint16(port[:]) | 1024
+
+	check := func(resp []byte) bool {
+		return len(resp) >= pcpMapSize &&
+			resp[0] == pcpVersion &&
+			resp[1] == pcpOpMap|pcpResponseBit &&
+			[12]byte(resp[24:36]) == nonce
+	}
+
+	resp, err := gatewayExchange(ctx, address, func(local netip.Addr) []byte {
+		return newPCPMapRequest(local, nonce, internalPort, pcpMapLifetime)
+	}, check)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("PCP request failed: %w", err)
+	}
+
+	if code := resp[3]; code != 0 {
+		return netip.Addr{}, fmt.Errorf("PCP request failed with result code %d", code)
+	}
+
+	addr := netip.AddrFrom16([16]byte(resp[44:60]))
+
+	// Best effort removal of the temporary mapping
+	gatewayExchange(ctx, address, func(local netip.Addr) []byte {
+		return newPCPMapRequest(local, nonce, internalPort, 0)
+	}, check)
+
+	return addr, nil
+}
+
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpService `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// wanService returns the first WAN connection service of the device tree.
+func (d upnpDevice) wanService() (upnpService, bool) {
+	for _, s := range d.Services {
+		if strings.HasPrefix(s.ServiceType, upnpWANIPConnection) ||
+			strings.HasPrefix(s.ServiceType, upnpWANPPPConnection) {
+			return s, true
+		}
+	}
+
+	for _, child := range d.Devices {
+		if s, ok := child.wanService(); ok {
+			return s, true
+		}
+	}
+
+	return upnpService{}, false
+}
+
+func (p *gatewayProvider) getUPnP(ctx context.Context, u *url.URL) (netip.Addr, error) {
+	location := "http://" + u.Host + u.RequestURI()
+	if u.Host == "" {
+		var err error
+		location, err = p.discoverSSDP(ctx)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("SSDP discovery failed: %w", err)
+		}
+	}
+
+	addr, err := p.upnpExternalIP(ctx, location)
+	if err != nil {
+		return addr, fmt.Errorf("%s: %w", location, err)
+	}
+
+	return addr, nil
+}
+
+// discoverSSDP searches for an Internet Gateway Device and returns the
+// location of the description of the first one answering.
+func (p *gatewayProvider) discoverSSDP(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, gatewayTimeout)
+	defer cancel()
+
+	dst, err := net.ResolveUDPAddr("udp4", p.ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpMulticastAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 1\r\n" +
+		"ST: " + ssdpSearchTarget + "\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), dst); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", err
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		if location := resp.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
+
+// upnpExternalIP reads the device description at the given location and
+// calls GetExternalIPAddress on its WAN connection service.
+func (p *gatewayProvider) upnpExternalIP(ctx context.Context, location string) (netip.Addr, error) {
+	var addr netip.Addr
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return addr, err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return addr, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return addr, fmt.Errorf("invalid response from gateway: %s", resp.Status)
+	}
+
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, upnpDescriptionMaxSize)).Decode(&root); err != nil {
+		return addr, fmt.Errorf("failed to decode the device description: %w", err)
+	}
+
+	service, ok := root.Device.wanService()
+	if !ok {
+		return addr, fmt.Errorf("no WAN connection service found")
+	}
+
+	base := location
+	if root.URLBase != "" {
+		base = root.URLBase
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return addr, err
+	}
+	controlURL, err := baseURL.Parse(service.ControlURL)
+	if err != nil {
+		return addr, err
+	}
+
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:GetExternalIPAddress xmlns:u="` + service.ServiceType + `"/></s:Body>` +
+		`</s:Envelope>`
+	req, err = http.NewRequestWithContext(ctx, "POST", controlURL.String(), strings.NewReader(body))
+	if err != nil {
+		return addr, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+service.ServiceType+`#GetExternalIPAddress"`)
+
+	resp, err = p.client.Do(req)
+	if err != nil {
+		return addr, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return addr, fmt.Errorf("GetExternalIPAddress failed: %s", resp.Status)
+	}
+
+	var envelope struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, upnpDescriptionMaxSize)).Decode(&envelope); err != nil {
+		return addr, fmt.Errorf("failed to decode the GetExternalIPAddress response: %w", err)
+	}
+
+	return netip.ParseAddr(strings.TrimSpace(envelope.IP))
+}
+
+// parseProcRoute parses the /proc/net/route format and returns the IPv4
+// default gateway. Addresses are stored in hexadecimal, in host byte order.
+func parseProcRoute(r io.Reader) (netip.Addr, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+
+		gw := netip.AddrFrom4([4]byte{raw[3], raw[2], raw[1], raw[0]})
+		if gw.IsUnspecified() {
+			continue
+		}
+
+		return gw, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return netip.Addr{}, err
+	}
+
+	return netip.Addr{}, fmt.Errorf("no default route")
+}
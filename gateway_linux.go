@@ -0,0 +1,17 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+)
+
+// defaultGateway returns the IPv4 default gateway from the routing table.
+func defaultGateway() (netip.Addr, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer file.Close()
+
+	return parseProcRoute(file)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// defaultGateway is only implemented on linux, the gateway address has to be
+// configured elsewhere.
+func defaultGateway() (netip.Addr, error) {
+	return netip.Addr{}, fmt.Errorf("default gateway detection is not supported, set the gateway address in the provider URL")
+}
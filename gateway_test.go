@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// testUDPServer starts a UDP server answering each request with the response
+// built by the handler, or nothing if it returns nil.
+func testUDPServer(t *testing.T, handler func(req []byte) []byte) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			if resp := handler(buf[:n]); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func natpmpResponse(code uint16, ip netip.Addr) []byte {
+	resp := []byte{natpmpVersion, natpmpOpExternalAddr | 0x80}
+	resp = binary.BigEndian.AppendUint16(resp, code)
+	resp = binary.BigEndian.AppendUint32(resp, 1234)
+	raw := ip.As4()
+	return append(resp, raw[:]...)
+}
+
+func pcpResponse(req []byte, code byte, ip netip.Addr) []byte {
+	resp := make([]byte, pcpMapSize)
+	copy(resp, req)
+	resp[1] = pcpOpMap | pcpResponseBit
+	resp[2] = 0
+	resp[3] = code
+	raw := netip.AddrFrom16(ip.As16()).As16()
+	if ip.Is4() {
+		raw = netip.AddrFrom16(netip.AddrFrom4(ip.As4()).As16()).As16()
+	}
+	copy(resp[44:60], raw[:])
+	return resp
+}
+
+const testIGDDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <serviceList>
+      <service>
+        <serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType>
+        <controlURL>/ctl/L3F</controlURL>
+      </service>
+    </serviceList>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+// testIGDServer starts an HTTP server acting as an Internet Gateway Device
+// reporting the given external address.
+func testIGDServer(t *testing.T, ip string) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testIGDDescription))
+	})
+	mux.HandleFunc("POST /ctl/IPConn", func(w http.ResponseWriter, r *http.Request) {
+		action := r.Header.Get("SOAPAction")
+		if action != `"urn:schemas-upnp-org:service:WANIPConnection:1#GetExternalIPAddress"` {
+			http.Error(w, "invalid action", http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
+  <s:Body>
+    <u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+      <NewExternalIPAddress>%s</NewExternalIPAddress>
+    </u:GetExternalIPAddressResponse>
+  </s:Body>
+</s:Envelope>`, ip)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGatewayProviderGet(t *testing.T) {
+	public := netip.MustParseAddr("203.0.113.1")
+
+	tests := []struct {
+		name     string
+		provider func(t *testing.T, p *gatewayProvider) string
+		rt       recordType
+		wantAddr netip.Addr
+		wantErr  bool
+	}{
+		{
+			name: "natpmp",
+			provider: func(t *testing.T, p *gatewayProvider) string {
+				return "natpmp://" + testUDPServer(t, func(req []byte) []byte {
+					return natpmpResponse(0, public)
+				})
+			},
+			wantAddr: public,
+		},
+		{
+			name: "natpmp error result",
+			provider: func(t *testing.T, p *gatewayProvider) string {
+				return "natpmp://" + testUDPServer(t, func(req []byte) []byte {
+					return natpmpResponse(3, netip.IPv4Unspecified())
+				})
+			},
+			wantErr: true,
+		},
+		{
+			name: "natpmp behind CGNAT",
+			provider: func(t *testing.T, p *gatewayProvider) string {
+				return "natpmp://" + testUDPServer(t, func(req []byte) []byte {
+					return natpmpResponse(0, netip.MustParseAddr("100.64.12.34"))
+				})
+			},
+			wantErr: true,
+		},
+		{
+			name: "natpmp default gateway",
+			provider: func(t *testing.T, p *gatewayProvider) string {
+				addr := testUDPServer(t, func(req []byte) []byte {
+					return natpmpResponse(0, public)
+				})
+				_, port, _ := net.SplitHostPort(addr)
+				return "natpmp://:" + port
+			},
+			wantAddr: public,
+		},
+		{
+			name: "natpmp AAAA record",
+			provider: func(t *testing.T, p *gatewayProvider) string {
+				return "natpmp://127.0.0.1"
+			},
+			rt:      recordTypeAAAA,
+			wantErr: true,
+		},
+		{
+			name: "pcp",
+			provider: func(t *testing.T, p *gatewayProvider) string {
+				return "pcp://" + testUDPServer(t, func(req []byte) []byte {
+					if len(req) != pcpMapSize || req[0] != pcpVersion || req[1] != pcpOpMap {
+						return nil
+					}
+					return pcpResponse(req, 0, public)
+				})
+			},
+			wantAddr: public,
+		},
+		{
+			name: "pcp behind another NAT",
+			provider: func(t *testing.T, p *gatewayProvider) string {
+				return "pcp://" + testUDPServer(t, func(req []byte) []byte {
+					return pcpResponse(req, 0, netip.MustParseAddr("192.168.1.2"))
+				})
+			},
+			wantErr: true,
+		},
+		{
+			name: "pcp error result",
+			provider: func(t *testing.T, p *gatewayProvider) string {
+				return "pcp://" + testUDPServer(t, func(req []byte) []byte {
+					return pcpResponse(req, 8, public)
+				})
+			},
+			wantErr: true,
+		},
+		{
+			name: "upnp description url",
+			provider: func(t *testing.T, p *gatewayProvider) string {
+				srv := testIGDServer(t, public.String())
+				return "upnp://" + strings.TrimPrefix(srv.URL, "http://") + "/rootDesc.xml"
+			},
+			wantAddr: public,
+		},
+		{
+			name: "upnp discovery",
+			provider: func(t *testing.T, p *gatewayProvider) string {
+				srv := testIGDServer(t, public.String())
+				p.ssdpAddr = testUDPServer(t, func(req []byte) []byte {
+					if !strings.HasPrefix(string(req), "M-SEARCH * HTTP/1.1\r\n") {
+						return nil
+					}
+					return []byte("HTTP/1.1 200 OK\r\n" +
+						"ST: " + ssdpSearchTarget + "\r\n" +
+						"LOCATION: " + srv.URL + "/rootDesc.xml\r\n\r\n")
+				})
+				return "upnp://"
+			},
+			wantAddr: public,
+		},
+		{
+			name: "upnp private address",
+			provider: func(t *testing.T, p *gatewayProvider) string {
+				srv := testIGDServer(t, "10.0.0.2")
+				return "upnp://" + strings.TrimPrefix(srv.URL, "http://") + "/rootDesc.xml"
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newGatewayProvider()
+			p.defaultGateway = func() (netip.Addr, error) {
+				return netip.MustParseAddr("127.0.0.1"), nil
+			}
+
+			rt := tc.rt
+			if rt == "" {
+				rt = recordTypeA
+			}
+
+			addr, err := p.Get(context.Background(), ipSource{URL: tc.provider(t, p)}, rt)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if addr != tc.wantAddr {
+				t.Fatalf("got %v, want %v", addr, tc.wantAddr)
+			}
+		})
+	}
+}
+
+func TestParseProcRoute(t *testing.T) {
+	input := strings.Join([]string{
+		"Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT",
+		"eth0\t0001A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0",
+		"eth0\t00000000\t0101A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0",
+	}, "\n")
+
+	gw, err := parseProcRoute(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if want := netip.MustParseAddr("192.168.1.1"); gw != want {
+		t.Fatalf("got %v, want %v", gw, want)
+	}
+
+	if _, err := parseProcRoute(strings.NewReader(input[:strings.LastIndex(input, "\n")])); err == nil {
+		t.Fatal("expected error without default route, got nil")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultHookTimeout = 30 * time.Second
+	// hookMaxOutput is the number of bytes of the output of a hook logged.
+	hookMaxOutput = 4 << 10
+)
+
+// hookCommand is the command of a hook, configured as a list of arguments
+// or as a string run by the shell.
+type hookCommand []string
+
+func (c *hookCommand) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*c = hookCommand{"/bin/sh", "-c", value.Value}
+		return nil
+	}
+
+	var args []string
+	if err := value.Decode(&args); err != nil {
+		return err
+	}
+
+	*c = args
+	return nil
+}
+
+// changeHook is a command run once a record target changed. It gets the
+// change in its environment:
+//   - WAYBACKD_HOSTNAME
+//   - WAYBACKD_RECORD_TYPE, A or AAAA
+//   - WAYBACKD_OLD_IP, empty if the record was created
+//   - WAYBACKD_NEW_IP
+type changeHook struct {
+	Command hookCommand   `yaml:"command"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (h changeHook) validate() error {
+	if len(h.Command) == 0 || h.Command[0] == "" {
+		return fmt.Errorf("on_change: missing command")
+	}
+
+	if h.Timeout < 0 {
+		return fmt.Errorf("on_change: invalid timeout %s", h.Timeout)
+	}
+
+	return nil
+}
+
+func (h changeHook) timeout() time.Duration {
+	if h.Timeout == 0 {
+		return defaultHookTimeout
+	}
+
+	return h.Timeout
+}
+
+// run executes the command with the given environment added, and returns
+// its combined output.
+func (h changeHook) run(ctx context.Context, env []string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+
+	var out cappedBuffer
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// Do not wait for the children keeping the output open once killed.
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %s: %w", h.timeout(), err)
+	}
+
+	return strings.TrimSpace(out.String()), err
+}
+
+// cappedBuffer keeps the first hookMaxOutput bytes written.
+type cappedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := hookMaxOutput - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+
+	return len(p), nil
+}
+
+// hookQueue runs the jobs one at a time in the order they were queued, so
+// the hooks of successive changes cannot finish out of order.
+type hookQueue struct {
+	mu      sync.Mutex
+	jobs    []func()
+	running bool
+	wg      sync.WaitGroup
+}
+
+// push queues the job, starting a goroutine running the queue if none is.
+func (q *hookQueue) push(job func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.jobs = append(q.jobs, job)
+	if q.running {
+		return
+	}
+
+	q.running = true
+	q.wg.Add(1)
+	go q.drain()
+}
+
+func (q *hookQueue) drain() {
+	defer q.wg.Done()
+
+	for {
+		q.mu.Lock()
+		if len(q.jobs) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		job := q.jobs[0]
+		q.jobs = q.jobs[1:]
+		q.mu.Unlock()
+
+		job()
+	}
+}
+
+// wait waits for the queue to be empty.
+func (q *hookQueue) wait() {
+	q.wg.Wait()
+}
+
+// runChangeHooks queues the global then the domain hooks of the applied
+// change, run in the background after the ones of the previous changes. A
+// failed hook is logged, the change is kept.
+func (a *app) runChangeHooks(ctx context.Context, c recordChange) {
+	hooks := slices.Concat(a.config.OnChange, c.domain.OnChange)
+	if len(hooks) == 0 {
+		return
+	}
+
+	var oldIP string
+	if c.current != nil {
+		oldIP = c.current.Target
+	}
+	hostname, t := c.domain.hostname(), recordTypeOf(c.ip)
+	env := []string{
+		"WAYBACKD_HOSTNAME=" + hostname,
+		"WAYBACKD_RECORD_TYPE=" + string(t),
+		"WAYBACKD_OLD_IP=" + oldIP,
+		"WAYBACKD_NEW_IP=" + c.ip.String(),
+	}
+
+	ctx = backgroundContext(ctx)
+	a.hooks.push(func() {
+		for _, h := range hooks {
+			out, err := h.run(ctx, env)
+			if err != nil {
+				slog.ErrorContext(ctx, "on_change hook failed", "hostname", hostname, "type", t,
+					"old_ip", oldIP, "new_ip", c.ip, "command", h.Command[0], "output", out, "error", err)
+				continue
+			}
+
+			slog.InfoContext(ctx, "on_change hook done", "hostname", hostname, "type", t,
+				"old_ip", oldIP, "new_ip", c.ip, "command", h.Command[0], "output", out)
+		}
+	})
+}
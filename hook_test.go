@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestHookCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want hookCommand
+	}{
+		{
+			name: "shell",
+			yaml: "wg set wg0 peer $PEER endpoint $WAYBACKD_NEW_IP:51820",
+			want: hookCommand{"/bin/sh", "-c", "wg set wg0 peer $PEER endpoint $WAYBACKD_NEW_IP:51820"},
+		},
+		{
+			name: "arguments",
+			yaml: "[systemctl, reload, nftables]",
+			want: hookCommand{"systemctl", "reload", "nftables"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got hookCommand
+			if err := yaml.Unmarshal([]byte(tc.yaml), &got); err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestChangeHookRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		hook    changeHook
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "environment",
+			hook: changeHook{Command: hookCommand{"/bin/sh", "-c", `echo "$WAYBACKD_HOSTNAME $WAYBACKD_NEW_IP"`}},
+			want: "home.example.com 203.0.113.1",
+		},
+		{
+			name:    "non-zero exit",
+			hook:    changeHook{Command: hookCommand{"/bin/sh", "-c", "echo failed >&2; exit 3"}},
+			want:    "failed",
+			wantErr: true,
+		},
+		{
+			name:    "timeout",
+			hook:    changeHook{Command: hookCommand{"/bin/sh", "-c", "sleep 10"}, Timeout: 50 * time.Millisecond},
+			wantErr: true,
+		},
+		{
+			name:    "missing command",
+			hook:    changeHook{Command: hookCommand{"/nonexistent/hook"}},
+			wantErr: true,
+		},
+	}
+
+	env := []string{"WAYBACKD_HOSTNAME=home.example.com", "WAYBACKD_NEW_IP=203.0.113.1"}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.hook.run(context.Background(), env)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+
+			if got != tc.want {
+				t.Fatalf("got output %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUpdateDomainsChangeHooks(t *testing.T) {
+	logs := testDefaultLogger(t)
+	dir := t.TempDir()
+	out := filepath.Join(dir, "hooks")
+	ip := netip.MustParseAddr("203.0.113.1")
+	oldIP := netip.MustParseAddr("198.51.100.1")
+
+	home := testDomain()
+	home.OnChange = []changeHook{{Command: hookCommand{"/bin/sh", "-c", `echo "domain $WAYBACKD_HOSTNAME" >> ` + out}}}
+	backend := newMockBackend()
+	backend.records[mockBackendKey(home, recordTypeA)] = record{ID: "1", Type: recordTypeA, Target: oldIP.String()}
+
+	a := &app{
+		config: config{
+			Provider: testProviders,
+			Domains:  []domain{home},
+			OnChange: []changeHook{
+				{Command: hookCommand{"/bin/sh", "-c", `echo "global $WAYBACKD_RECORD_TYPE $WAYBACKD_OLD_IP $WAYBACKD_NEW_IP" >> ` + out}},
+				{Command: hookCommand{"/bin/sh", "-c", "echo HOOKOUT; exit 1"}},
+			},
+		},
+		backends:    map[string]DNSBackend{defaultBackend: backend},
+		ipProvider:  &mockIPProvider{addr: ip},
+		dnsProvider: &mockDNSProvider{addr: oldIP},
+	}
+
+	a.tryUpdateDomainsIfNeeded(context.Background())
+	a.hooks.wait()
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "global A 198.51.100.1 203.0.113.1\ndomain home.example.com\n"
+	if string(data) != want {
+		t.Fatalf("got hooks output:\n%s\nwant:\n%s", data, want)
+	}
+
+	// The hooks are logged once the update logs were flushed.
+	if got := logs.String(); strings.Count(got, "on_change hook done") != 2 ||
+		!strings.Contains(got, "on_change hook failed") || !strings.Contains(got, "output=HOOKOUT") {
+		t.Fatalf("expected the hooks to be logged, got:\n%s", got)
+	}
+
+	// The failed hook keeps the update.
+	if got := backend.records[mockBackendKey(home, recordTypeA)].Target; got != ip.String() {
+		t.Fatalf("got target %s, want %s", got, ip)
+	}
+	if len(a.retries) != 0 {
+		t.Fatalf("expected no retry, got %v", a.retries)
+	}
+
+	// Nothing runs when the record did not change.
+	os.Remove(out)
+	a.dnsProvider = &mockDNSProvider{addr: ip}
+	a.tryUpdateDomainsIfNeeded(context.Background())
+	a.hooks.wait()
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("expected no hook to run, got %v", err)
+	}
+}
+
+func TestHookQueue(t *testing.T) {
+	var q hookQueue
+	var mu sync.Mutex
+	var got []int
+	for round := range 2 {
+		for i := range 3 {
+			q.push(func() {
+				// The first job is the slowest, the others wait for it.
+				if i == 0 {
+					time.Sleep(10 * time.Millisecond)
+				}
+				mu.Lock()
+				got = append(got, round*3+i)
+				mu.Unlock()
+			})
+		}
+		q.wait()
+	}
+
+	if want := []int{0, 1, 2, 3, 4, 5}; !slices.Equal(got, want) {
+		t.Fatalf("got jobs %v, want %v", got, want)
+	}
+}
+
+func TestWaitBackground(t *testing.T) {
+	a := &app{}
+	release := make(chan struct{})
+	a.hooks.push(func() { <-release })
+
+	start := time.Now()
+	a.waitBackground(10 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("waited %s for a stuck hook", elapsed)
+	}
+
+	close(release)
+	a.waitBackground(time.Second)
+}
+
+func TestParseConfigChangeHooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := strings.Join([]string{
+		"on_change:",
+		"  - command: systemctl reload nftables",
+		"domains:",
+		"  - domain: example.com",
+		"    sub_domain: home",
+		"    on_change:",
+		"      - command: []",
+	}, "\n")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parseConfig(path); err == nil || !strings.Contains(err.Error(), "missing command") {
+		t.Fatalf("got error %v, want a missing command", err)
+	}
+}
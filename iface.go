@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// IPv6 address flags, as defined in linux/if_addr.h.
+const (
+	ifaFlagTemporary  = 0x01
+	ifaFlagDADFailed  = 0x08
+	ifaFlagDeprecated = 0x20
+	ifaFlagTentative  = 0x40
+
+	// ifaFlagsUnusable are the flags of addresses that should not be
+	// published.
+	ifaFlagsUnusable = ifaFlagTemporary | ifaFlagDADFailed | ifaFlagDeprecated | ifaFlagTentative
+)
+
+// ifaceAddr is an address bound to a network interface.
+type ifaceAddr struct {
+	addr  netip.Addr
+	flags uint32
+}
+
+// usable returns true if the address can be published in a record of the
+// given type. Link-local, ULA, temporary and deprecated addresses are
+// filtered out.
+func (a ifaceAddr) usable(t recordType) bool {
+	if !t.match(a.addr) || !a.addr.IsGlobalUnicast() {
+		return false
+	}
+
+	if a.addr.Is6() && a.addr.IsPrivate() {
+		return false
+	}
+
+	return a.flags&ifaFlagsUnusable == 0
+}
+
+// ifaceProvider reads the IP from a local network interface, configured as
+// iface://ppp0.
+type ifaceProvider struct {
+	addrs func(name string) ([]ifaceAddr, error)
+}
+
+func newIfaceProvider() *ifaceProvider {
+	return &ifaceProvider{addrs: interfaceAddrs}
+}
+
+func (p *ifaceProvider) Get(_ context.Context, provider ipSource, t recordType) (netip.Addr, error) {
+	var addr netip.Addr
+	u, err := url.Parse(provider.URL)
+	if err != nil {
+		return addr, err
+	}
+
+	name := u.Host
+	if name == "" {
+		return addr, fmt.Errorf("missing interface name in %q", provider.URL)
+	}
+
+	addrs, err := p.addrs(name)
+	if err != nil {
+		return addr, err
+	}
+
+	for _, a := range addrs {
+		if a.usable(t) {
+			return a.addr, nil
+		}
+	}
+
+	return addr, fmt.Errorf("no usable %s address on interface %s", t, name)
+}
+
+// interfaceAddrs returns the addresses bound to the named interface, along
+// with their flags when the platform exposes them.
+func interfaceAddrs(name string) ([]ifaceAddr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	netAddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	flags, err := inet6AddrFlags(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IPv6 address flags: %w", err)
+	}
+
+	addrs := make([]ifaceAddr, 0, len(netAddrs))
+	for _, netAddr := range netAddrs {
+		ipNet, ok := netAddr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		addr, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+
+		addr = addr.Unmap()
+		addrs = append(addrs, ifaceAddr{addr: addr, flags: flags[addr]})
+	}
+
+	return addrs, nil
+}
+
+// parseIfInet6 parses the /proc/net/if_inet6 format and returns the flags of
+// the addresses of the named interface. Each line holds the address, the
+// interface index, the prefix length, the scope, the flags and the interface
+// name.
+func parseIfInet6(r io.Reader, name string) (map[netip.Addr]uint32, error) {
+	flags := map[netip.Addr]uint32{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 6 || fields[5] != name {
+			continue
+		}
+
+		raw, err := hex.DecodeString(fields[0])
+		if err != nil || len(raw) != 16 {
+			return nil, fmt.Errorf("invalid address %q", fields[0])
+		}
+
+		f, err := strconv.ParseUint(fields[4], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid flags %q: %w", fields[4], err)
+		}
+
+		flags[netip.AddrFrom16([16]byte(raw))] = uint32(f)
+	}
+
+	return flags, scanner.Err()
+}
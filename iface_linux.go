@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+)
+
+// inet6AddrFlags returns the flags of the IPv6 addresses of the named
+// interface.
+func inet6AddrFlags(name string) (map[netip.Addr]uint32, error) {
+	file, err := os.Open("/proc/net/if_inet6")
+	if err != nil {
+		if os.IsNotExist(err) {
+			// IPv6 is disabled
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseIfInet6(file, name)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "net/netip"
+
+// inet6AddrFlags is only implemented on linux, the addresses are considered
+// usable elsewhere.
+func inet6AddrFlags(string) (map[netip.Addr]uint32, error) {
+	return nil, nil
+}
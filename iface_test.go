@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestIfaceProviderGet(t *testing.T) {
+	addrs := []ifaceAddr{
+		{addr: netip.MustParseAddr("169.254.1.1")},
+		{addr: netip.MustParseAddr("203.0.113.1")},
+		{addr: netip.MustParseAddr("fe80::1")},
+		{addr: netip.MustParseAddr("fd00::1")},
+		{addr: netip.MustParseAddr("2001:db8::dead"), flags: ifaFlagTemporary},
+		{addr: netip.MustParseAddr("2001:db8::beef"), flags: ifaFlagDeprecated},
+		{addr: netip.MustParseAddr("2001:db8::1")},
+	}
+
+	tests := []struct {
+		name     string
+		provider string
+		addrs    []ifaceAddr
+		rt       recordType
+		wantAddr netip.Addr
+		wantErr  bool
+	}{
+		{
+			name:     "ipv4",
+			provider: "iface://ppp0",
+			addrs:    addrs,
+			rt:       recordTypeA,
+			wantAddr: netip.MustParseAddr("203.0.113.1"),
+		},
+		{
+			name:     "ipv6 skips link-local, ULA, temporary and deprecated",
+			provider: "iface://ppp0",
+			addrs:    addrs,
+			rt:       recordTypeAAAA,
+			wantAddr: netip.MustParseAddr("2001:db8::1"),
+		},
+		{
+			name:     "no usable address",
+			provider: "iface://ppp0",
+			addrs:    addrs[:1],
+			rt:       recordTypeA,
+			wantErr:  true,
+		},
+		{
+			name:     "unknown interface",
+			provider: "iface://wan0",
+			rt:       recordTypeA,
+			wantErr:  true,
+		},
+		{
+			name:     "missing interface name",
+			provider: "iface://",
+			rt:       recordTypeA,
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &ifaceProvider{addrs: func(name string) ([]ifaceAddr, error) {
+				if name != "ppp0" {
+					return nil, fmt.Errorf("no such network interface")
+				}
+				return tc.addrs, nil
+			}}
+
+			addr, err := p.Get(context.Background(), ipSource{URL: tc.provider}, tc.rt)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if addr != tc.wantAddr {
+				t.Fatalf("got %v, want %v", addr, tc.wantAddr)
+			}
+		})
+	}
+}
+
+func TestParseIfInet6(t *testing.T) {
+	input := strings.Join([]string{
+		"fe800000000000000000000000000001 02 40 20 80     ppp0",
+		"20010db8000000000000000000000001 02 40 00 00     ppp0",
+		"20010db80000000000000000deadbeef 02 40 00 01     ppp0",
+		"20010db8000000000000000000000002 03 40 00 20     eth0",
+	}, "\n")
+
+	flags, err := parseIfInet6(strings.NewReader(input), "ppp0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[netip.Addr]uint32{
+		netip.MustParseAddr("fe80::1"):             0x80,
+		netip.MustParseAddr("2001:db8::1"):         0,
+		netip.MustParseAddr("2001:db8::dead:beef"): ifaFlagTemporary,
+	}
+
+	if len(flags) != len(want) {
+		t.Fatalf("got %v, want %v", flags, want)
+	}
+	for addr, f := range want {
+		if got, ok := flags[addr]; !ok || got != f {
+			t.Fatalf("got flags %v for %s, want %v", got, addr, f)
+		}
+	}
+}
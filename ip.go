@@ -3,32 +3,244 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Default response body size limits, plain responses only holding an IP.
+const (
+	defaultMaxBodySize           = 64
+	defaultStructuredMaxBodySize = 64 << 10
 )
 
 type IPProvider interface {
-	Get(ctx context.Context, provider string) (netip.Addr, error)
+	Get(ctx context.Context, provider ipSource, t recordType) (netip.Addr, error)
+}
+
+// ipSource is a provider URL along with the options used to query it and to
+// parse its response. It can be configured as the URL only.
+type ipSource struct {
+	URL string `yaml:"url"`
+	// JSON is the dot separated path of the field holding the IP in a JSON
+	// response, e.g. "ip" or "data.addresses.0".
+	JSON string `yaml:"json"`
+	// Regexp is a regular expression extracting the IP from its first
+	// capture group.
+	Regexp string `yaml:"regexp"`
+	// Headers are added to the request, e.g. to pass an API token.
+	Headers map[string]string `yaml:"headers"`
+	// MaxBodySize is the maximum number of bytes read from the response.
+	MaxBodySize int64 `yaml:"max_body_size"`
+
+	re *regexp.Regexp
+}
+
+func (s ipSource) String() string {
+	return s.URL
+}
+
+func (s *ipSource) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*s = ipSource{URL: value.Value}
+		return nil
+	}
+
+	type plain ipSource
+	if err := value.Decode((*plain)(s)); err != nil {
+		return err
+	}
+
+	if s.URL == "" {
+		return fmt.Errorf("missing provider url")
+	}
+
+	if s.JSON != "" && s.Regexp != "" {
+		return fmt.Errorf("%s: json and regexp are mutually exclusive", s.URL)
+	}
+
+	if s.Regexp != "" {
+		re, err := regexp.Compile(s.Regexp)
+		if err != nil {
+			return fmt.Errorf("%s: invalid regexp: %w", s.URL, err)
+		}
+
+		if re.NumSubexp() < 1 {
+			return fmt.Errorf("%s: regexp needs a capture group", s.URL)
+		}
+
+		s.re = re
+	}
+
+	return nil
+}
+
+// maxBodySize returns the number of bytes to read from the response.
+func (s ipSource) maxBodySize() int64 {
+	switch {
+	case s.MaxBodySize > 0:
+		return s.MaxBodySize
+	case s.JSON != "" || s.re != nil:
+		return defaultStructuredMaxBodySize
+	default:
+		return defaultMaxBodySize
+	}
+}
+
+// extract returns the IP found in the response body.
+func (s ipSource) extract(body []byte) ([]byte, error) {
+	switch {
+	case s.JSON != "":
+		return extractJSON(body, s.JSON)
+	case s.re != nil:
+		match := s.re.FindSubmatch(body)
+		if match == nil {
+			return nil, fmt.Errorf("regexp did not match the response")
+		}
+		return bytes.TrimSpace(match[1]), nil
+	default:
+		return bytes.TrimRight(body, "\n"), nil
+	}
+}
+
+// extractJSON returns the value found at the dot separated path in the JSON
+// document. Numeric path elements are used as array indexes.
+func extractJSON(body []byte, path string) ([]byte, error) {
+	var value any
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil, fmt.Errorf("invalid JSON response: %w", err)
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]any:
+			var ok bool
+			if value, ok = v[key]; !ok {
+				return nil, fmt.Errorf("field %q not found in the response", path)
+			}
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("field %q not found in the response", path)
+			}
+			value = v[i]
+		default:
+			return nil, fmt.Errorf("field %q not found in the response", path)
+		}
+	}
+
+	str, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("field %q is not a string", path)
+	}
+
+	return []byte(strings.TrimSpace(str)), nil
+}
+
+// ipProviderMux dispatches each provider to the IPProvider registered for the
+// scheme of its URL.
+type ipProviderMux map[string]IPProvider
+
+func newIPProviderMux() ipProviderMux {
+	httpProvider := newIpProvider()
+	gatewayProvider := newGatewayProvider()
+	return ipProviderMux{
+		"http":   httpProvider,
+		"https":  httpProvider,
+		"iface":  newIfaceProvider(),
+		"dns":    newDNSIPProvider(),
+		"stun":   newSTUNProvider(),
+		"upnp":   gatewayProvider,
+		"natpmp": gatewayProvider,
+		"pcp":    gatewayProvider,
+	}
+}
+
+func (m ipProviderMux) provider(provider ipSource) (IPProvider, error) {
+	u, err := url.Parse(provider.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	p, ok := m[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported provider scheme %q", u.Scheme)
+	}
+
+	return p, nil
+}
+
+// validate ensures every configured provider is supported.
+func (m ipProviderMux) validate(providers providerList) error {
+	for _, provider := range providers {
+		if _, err := m.provider(provider); err != nil {
+			return fmt.Errorf("%s: %w", provider, err)
+		}
+	}
+
+	return nil
+}
+
+func (m ipProviderMux) Get(ctx context.Context, provider ipSource, t recordType) (netip.Addr, error) {
+	p, err := m.provider(provider)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	return p.Get(ctx, provider, t)
 }
 
 type ipProvider struct {
-	client *http.Client
+	// clients holds one HTTP client per record type, each one only dialing
+	// the matching IP family.
+	clients map[recordType]*http.Client
 }
 
 func newIpProvider() *ipProvider {
-	return &ipProvider{client: http.DefaultClient}
+	return &ipProvider{clients: map[recordType]*http.Client{
+		recordTypeA:    newFamilyClient("tcp4"),
+		recordTypeAAAA: newFamilyClient("tcp6"),
+	}}
 }
 
-func (p *ipProvider) Get(ctx context.Context, provider string) (netip.Addr, error) {
+// newFamilyClient returns an HTTP client forced to dial using the given
+// network, so the provider sees the address of the requested family.
+func newFamilyClient(network string) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, _, address string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+
+	return &http.Client{Transport: transport}
+}
+
+func (p *ipProvider) Get(ctx context.Context, provider ipSource, t recordType) (netip.Addr, error) {
 	var addr netip.Addr
-	req, err := http.NewRequestWithContext(ctx, "GET", provider, nil)
+	client, ok := p.clients[t]
+	if !ok {
+		return addr, fmt.Errorf("unsupported record type %q", t)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", provider.URL, nil)
 	if err != nil {
 		return addr, err
 	}
 
-	resp, err := p.client.Do(req)
+	for k, v := range provider.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return addr, err
 	}
@@ -38,13 +250,17 @@ func (p *ipProvider) Get(ctx context.Context, provider string) (netip.Addr, erro
 		return addr, fmt.Errorf("invalid response from server: %s", resp.Status)
 	}
 
-	bodyReader := io.LimitReader(resp.Body, 64)
+	bodyReader := io.LimitReader(resp.Body, provider.maxBodySize())
 
 	body, err := io.ReadAll(bodyReader)
 	if err != nil {
 		return addr, err
 	}
-	body = bytes.TrimRight(body, "\n")
+
+	body, err = provider.extract(body)
+	if err != nil {
+		return addr, err
+	}
 
 	if err := addr.UnmarshalText(body); err != nil {
 		return addr, err
@@ -54,5 +270,10 @@ func (p *ipProvider) Get(ctx context.Context, provider string) (netip.Addr, erro
 		return addr, fmt.Errorf("invalid IP from provider")
 	}
 
+	addr = addr.Unmap()
+	if !t.match(addr) {
+		return addr, fmt.Errorf("got %s from provider, expected an %s address", addr, t)
+	}
+
 	return addr, nil
 }
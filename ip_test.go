@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
+	"regexp"
 	"testing"
 )
 
@@ -12,6 +13,7 @@ func TestIPProviderGet(t *testing.T) {
 	tests := []struct {
 		name       string
 		body       string
+		recordType recordType
 		statusCode int
 		wantAddr   netip.Addr
 		wantErr    bool
@@ -31,9 +33,23 @@ func TestIPProviderGet(t *testing.T) {
 		{
 			name:       "valid ipv6",
 			body:       "2001:db8::1",
+			recordType: recordTypeAAAA,
 			statusCode: http.StatusOK,
 			wantAddr:   netip.MustParseAddr("2001:db8::1"),
 		},
+		{
+			name:       "ipv6 for an A record",
+			body:       "2001:db8::1",
+			statusCode: http.StatusOK,
+			wantErr:    true,
+		},
+		{
+			name:       "ipv4 for an AAAA record",
+			body:       "203.0.113.1",
+			recordType: recordTypeAAAA,
+			statusCode: http.StatusOK,
+			wantErr:    true,
+		},
 		{
 			name:       "server error",
 			body:       "",
@@ -62,8 +78,124 @@ func TestIPProviderGet(t *testing.T) {
 			}))
 			defer srv.Close()
 
-			p := &ipProvider{client: srv.Client()}
-			addr, err := p.Get(context.Background(), srv.URL)
+			p := &ipProvider{clients: map[recordType]*http.Client{
+				recordTypeA:    srv.Client(),
+				recordTypeAAAA: srv.Client(),
+			}}
+
+			rt := tc.recordType
+			if rt == "" {
+				rt = recordTypeA
+			}
+
+			addr, err := p.Get(context.Background(), ipSource{URL: srv.URL}, rt)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if addr != tc.wantAddr {
+				t.Fatalf("got %v, want %v", addr, tc.wantAddr)
+			}
+		})
+	}
+}
+
+func TestIPProviderGetStructured(t *testing.T) {
+	regexpSource := func(expr string) ipSource {
+		return ipSource{Regexp: expr, re: regexp.MustCompile(expr)}
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		source   ipSource
+		wantAddr netip.Addr
+		wantErr  bool
+	}{
+		{
+			name:     "json field",
+			body:     `{"ip": "203.0.113.1", "country": "FR"}`,
+			source:   ipSource{JSON: "ip"},
+			wantAddr: netip.MustParseAddr("203.0.113.1"),
+		},
+		{
+			name:     "nested json field",
+			body:     `{"data": {"addresses": ["2001:db8::1", "203.0.113.1"]}}`,
+			source:   ipSource{JSON: "data.addresses.1"},
+			wantAddr: netip.MustParseAddr("203.0.113.1"),
+		},
+		{
+			name:    "missing json field",
+			body:    `{"address": "203.0.113.1"}`,
+			source:  ipSource{JSON: "ip"},
+			wantErr: true,
+		},
+		{
+			name:    "json field is not a string",
+			body:    `{"ip": 42}`,
+			source:  ipSource{JSON: "ip"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid json",
+			body:    `<html></html>`,
+			source:  ipSource{JSON: "ip"},
+			wantErr: true,
+		},
+		{
+			name:     "regexp",
+			body:     "<html><body>Current IP Address: 203.0.113.1</body></html>",
+			source:   regexpSource(`Current IP Address: ([0-9.]+)`),
+			wantAddr: netip.MustParseAddr("203.0.113.1"),
+		},
+		{
+			name:    "regexp not matching",
+			body:    "<html><body>Unavailable</body></html>",
+			source:  regexpSource(`Current IP Address: ([0-9.]+)`),
+			wantErr: true,
+		},
+		{
+			name:    "body larger than the limit",
+			body:    `{"ip": "203.0.113.1"}`,
+			source:  ipSource{JSON: "ip", MaxBodySize: 10},
+			wantErr: true,
+		},
+		{
+			name:     "custom headers",
+			body:     `{"ip": "203.0.113.1"}`,
+			source:   ipSource{JSON: "ip", Headers: map[string]string{"Authorization": "Bearer secret"}},
+			wantAddr: netip.MustParseAddr("203.0.113.1"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tc.source.Headers {
+					if r.Header.Get(k) != v {
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+				}
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			p := &ipProvider{clients: map[recordType]*http.Client{
+				recordTypeA: srv.Client(),
+			}}
+
+			source := tc.source
+			source.URL = srv.URL
+			addr, err := p.Get(context.Background(), source, recordTypeA)
 
 			if tc.wantErr {
 				if err == nil {
@@ -82,3 +214,25 @@ func TestIPProviderGet(t *testing.T) {
 		})
 	}
 }
+
+func TestIPProviderMux(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+	mock := &mockIPProvider{addr: ip}
+	mux := ipProviderMux{"iface": mock}
+
+	addr, err := mux.Get(context.Background(), ipSource{URL: "iface://ppp0"}, recordTypeA)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if addr != ip || mock.gets != 1 {
+		t.Fatalf("got %v after %d calls, want %v after 1 call", addr, mock.gets, ip)
+	}
+
+	if err := mux.validate(sources("iface://ppp0", "gopher://ip.example.net")); err == nil {
+		t.Fatal("expected error for unsupported scheme, got nil")
+	}
+
+	if _, err := mux.Get(context.Background(), ipSource{URL: "gopher://ip.example.net"}, recordTypeA); err == nil {
+		t.Fatal("expected error for unsupported scheme, got nil")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+type logFormat string
+
+const (
+	logFormatText logFormat = "text"
+	logFormatJSON logFormat = "json"
+)
+
+func (f logFormat) valid() bool {
+	return f == "" || f == logFormatText || f == logFormatJSON
+}
+
+// parseLogLevel returns the level named debug, info, warn or error, info by
+// default.
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if name == "" {
+		return level, nil
+	}
+
+	if err := level.UnmarshalText([]byte(strings.ToUpper(name))); err != nil {
+		return level, fmt.Errorf("invalid log level %q", name)
+	}
+
+	return level, nil
+}
+
+// newLogger returns the logger writing to w in the configured format, from
+// the configured level.
+func newLogger(w io.Writer, cfg config) (*slog.Logger, error) {
+	level, err := parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch cfg.LogFormat {
+	case logFormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	case "", logFormatText:
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", cfg.LogFormat)
+	}
+
+	return slog.New(&bufferHandler{Handler: handler}), nil
+}
+
+// logBuffer holds the records logged by a task running concurrently with
+// others, to print them in a deterministic order once it is done. The
+// records logged once flushed, e.g. by a background delivery started by the
+// task, are printed right away.
+type logBuffer struct {
+	mu      sync.Mutex
+	records []bufferedRecord
+	flushed bool
+}
+
+type bufferedRecord struct {
+	handler slog.Handler
+	record  slog.Record
+}
+
+type logBufferKey struct{}
+
+// withLogBuffer returns a context buffering the records logged with it.
+func withLogBuffer(ctx context.Context) (context.Context, *logBuffer) {
+	b := &logBuffer{}
+	return context.WithValue(ctx, logBufferKey{}, b), b
+}
+
+func (b *logBuffer) handle(ctx context.Context, h slog.Handler, r slog.Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.flushed {
+		return h.Handle(ctx, r)
+	}
+
+	b.records = append(b.records, bufferedRecord{handler: h, record: r.Clone()})
+	return nil
+}
+
+// flush prints the buffered records.
+func (b *logBuffer) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, r := range b.records {
+		r.handler.Handle(context.Background(), r.record)
+	}
+	b.records = nil
+	b.flushed = true
+}
+
+// bufferHandler keeps the records logged with a context holding a logBuffer
+// in it, the others are handled right away.
+type bufferHandler struct {
+	slog.Handler
+}
+
+func (h *bufferHandler) Handle(ctx context.Context, r slog.Record) error {
+	if b, ok := ctx.Value(logBufferKey{}).(*logBuffer); ok {
+		return b.handle(ctx, h.Handler, r)
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *bufferHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &bufferHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *bufferHandler) WithGroup(name string) slog.Handler {
+	return &bufferHandler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testLogWithoutTime removes the time from the records, to compare the logs.
+func testLogWithoutTime(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.TimeKey && len(groups) == 0 {
+		return slog.Attr{}
+	}
+	return a
+}
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "text by default",
+			want: `level=INFO msg="updating the zone record" hostname=home.example.com old_ip=198.51.100.1 new_ip=203.0.113.1`,
+		},
+		{
+			name: "json",
+			cfg:  config{LogFormat: logFormatJSON},
+			want: `{"level":"INFO","msg":"updating the zone record","hostname":"home.example.com","old_ip":"198.51.100.1","new_ip":"203.0.113.1"}`,
+		},
+		{
+			name: "level filtered",
+			cfg:  config{LogLevel: "warn"},
+		},
+		{
+			name:    "invalid level",
+			cfg:     config{LogLevel: "verbose"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid format",
+			cfg:     config{LogFormat: "xml"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			logger, err := newLogger(&out, tc.cfg)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			logger.Info("updating the zone record", "hostname", "home.example.com",
+				"old_ip", netip.MustParseAddr("198.51.100.1"), "new_ip", netip.MustParseAddr("203.0.113.1"))
+
+			got := out.String()
+			if tc.want == "" {
+				if got != "" {
+					t.Fatalf("expected no logs, got %s", got)
+				}
+				return
+			}
+
+			// The time is dropped to compare the records.
+			if tc.cfg.LogFormat == logFormatJSON {
+				var got, want map[string]any
+				if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+				delete(got, slog.TimeKey)
+				json.Unmarshal([]byte(tc.want), &want)
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("got %v, want %v", got, want)
+				}
+				return
+			}
+
+			_, got, _ = strings.Cut(strings.TrimSpace(got), " ")
+			if got != tc.want {
+				t.Fatalf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLogBuffer(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(&bufferHandler{Handler: slog.NewTextHandler(&out, &slog.HandlerOptions{
+		ReplaceAttr: testLogWithoutTime,
+	})}).With("zone", "example.com")
+
+	ctx, buf := withLogBuffer(context.Background())
+	logger.InfoContext(ctx, "buffered")
+	logger.Info("direct")
+	buf.flush()
+	logger.InfoContext(ctx, "flushed")
+
+	want := "level=INFO msg=direct zone=example.com\nlevel=INFO msg=buffered zone=example.com\n" +
+		"level=INFO msg=flushed zone=example.com\n"
+	if out.String() != want {
+		t.Fatalf("got logs:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// testDefaultLogger makes the default logger write to the returned buffer
+// for the duration of the test.
+func testDefaultLogger(t *testing.T) *syncBuffer {
+	t.Helper()
+
+	out := &syncBuffer{}
+	logger, err := newLogger(out, config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return out
+}
@@ -8,16 +8,17 @@ import (
 
 func main() {
 	var configPath string
-	var setup bool
+	var setup, serve bool
 	flag.StringVar(&configPath, "config", "config.yaml", "config file path")
 	flag.BoolVar(&setup, "setup", false, "request an OVH consumer key")
+	flag.BoolVar(&serve, "serve", false, "serve the dyndns2 update endpoint instead of checking the IP")
 	flag.Parse()
 
 	var err error
 	if setup {
 		err = runSetup(configPath)
 	} else {
-		err = run(configPath)
+		err = run(configPath, serve)
 	}
 
 	if err != nil {
@@ -26,11 +27,15 @@ func main() {
 	}
 }
 
-func run(configPath string) error {
+func run(configPath string, serve bool) error {
 	app, err := newApp(configPath)
 	if err != nil {
 		return err
 	}
 
+	if serve {
+		return app.serve()
+	}
+
 	return app.run()
 }
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+)
+
+// metricsBuckets are the upper bounds of the latency histogram buckets, in
+// seconds.
+var metricsBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts the observations in cumulative buckets.
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(metricsBuckets))
+	}
+
+	for i, bound := range metricsBuckets {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// metrics holds the series exposed in the Prometheus text format, keyed by
+// their formatted labels. A nil metrics records nothing.
+type metrics struct {
+	mu                sync.Mutex
+	ipProviderSeconds map[string]*histogram
+	ipProviderErrors  map[string]float64
+	dnsLookups        map[string]float64
+	ovhRequests       map[string]float64
+	recordUpdates     map[string]float64
+	lastSuccess       map[string]float64
+	// published holds the labels of the published address info, keyed by
+	// hostname and type.
+	published map[string]string
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		ipProviderSeconds: map[string]*histogram{},
+		ipProviderErrors:  map[string]float64{},
+		dnsLookups:        map[string]float64{},
+		ovhRequests:       map[string]float64{},
+		recordUpdates:     map[string]float64{},
+		lastSuccess:       map[string]float64{},
+		published:         map[string]string{},
+	}
+}
+
+// metricLabels formats the label pairs, escaping their values.
+func metricLabels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// observeIPProvider records the latency and the result of a request to an IP
+// provider.
+func (m *metrics) observeIPProvider(provider ipSource, t recordType, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := metricLabels("provider", provider.URL, "type", string(t))
+	h, ok := m.ipProviderSeconds[labels]
+	if !ok {
+		h = &histogram{}
+		m.ipProviderSeconds[labels] = h
+	}
+	h.observe(d.Seconds())
+
+	if err != nil {
+		m.ipProviderErrors[labels]++
+	}
+}
+
+// observeDNSLookup records the result of a lookup: match, mismatch or error.
+func (m *metrics) observeDNSLookup(hostname string, t recordType, result string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dnsLookups[metricLabels("hostname", hostname, "type", string(t), "result", result)]++
+}
+
+// observeOVHRequest records an OVH API call along with its HTTP status,
+// "error" if the API could not be reached.
+func (m *metrics) observeOVHRequest(method string, err error) {
+	if m == nil {
+		return
+	}
+
+	status := strconv.Itoa(http.StatusOK)
+	var apiErr *ovh.APIError
+	switch {
+	case errors.As(err, &apiErr):
+		status = strconv.Itoa(apiErr.Code)
+	case err != nil:
+		status = "error"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ovhRequests[metricLabels("method", method, "status", status)]++
+}
+
+// observeUpdate records an update of a record: success or failure.
+func (m *metrics) observeUpdate(hostname string, t recordType, result string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.recordUpdates[metricLabels("hostname", hostname, "type", string(t), "result", result)]++
+}
+
+// setLastSuccess records the time of the last successful check of the
+// hostname.
+func (m *metrics) setLastSuccess(hostname string, at time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastSuccess[metricLabels("hostname", hostname)] = float64(at.Unix())
+}
+
+// setPublished records the address currently published for the hostname.
+func (m *metrics) setPublished(hostname string, ip netip.Addr) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := recordTypeOf(ip)
+	m.published[hostname+"/"+string(t)] = metricLabels("hostname", hostname, "type", string(t), "address", ip.String())
+}
+
+// writeTo writes the metrics in the Prometheus text exposition format.
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP waybackd_ip_provider_request_duration_seconds Latency of the requests to the IP providers.")
+	fmt.Fprintln(w, "# TYPE waybackd_ip_provider_request_duration_seconds histogram")
+	for _, labels := range slices.Sorted(maps.Keys(m.ipProviderSeconds)) {
+		h := m.ipProviderSeconds[labels]
+		prefix := strings.TrimSuffix(labels, "}")
+		for i, bound := range metricsBuckets {
+			fmt.Fprintf(w, "waybackd_ip_provider_request_duration_seconds_bucket%s,le=\"%s\"} %d\n",
+				prefix, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+		}
+		fmt.Fprintf(w, "waybackd_ip_provider_request_duration_seconds_bucket%s,le=\"+Inf\"} %d\n", prefix, h.count)
+		fmt.Fprintf(w, "waybackd_ip_provider_request_duration_seconds_sum%s %s\n", labels, formatMetric(h.sum))
+		fmt.Fprintf(w, "waybackd_ip_provider_request_duration_seconds_count%s %d\n", labels, h.count)
+	}
+
+	writeMetric(w, "waybackd_ip_provider_errors_total", "counter", "Failed requests to the IP providers.", m.ipProviderErrors)
+	writeMetric(w, "waybackd_dns_lookups_total", "counter", "DNS lookups of the hostnames by result.", m.dnsLookups)
+	writeMetric(w, "waybackd_ovh_api_requests_total", "counter", "OVH API calls by method and HTTP status.", m.ovhRequests)
+	writeMetric(w, "waybackd_record_updates_total", "counter", "Record updates by hostname and result.", m.recordUpdates)
+	writeMetric(w, "waybackd_last_success_timestamp_seconds", "gauge", "Time of the last successful check of the hostname.", m.lastSuccess)
+
+	info := map[string]float64{}
+	for _, labels := range m.published {
+		info[labels] = 1
+	}
+	writeMetric(w, "waybackd_published_address_info", "gauge", "Address currently published for the hostname.", info)
+}
+
+func writeMetric(w io.Writer, name, kind, help string, series map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	for _, labels := range slices.Sorted(maps.Keys(series)) {
+		fmt.Fprintf(w, "%s%s %s\n", name, labels, formatMetric(series[labels]))
+	}
+}
+
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.writeTo(w)
+}
+
+// metricsOVHClient records the calls made to the OVH API.
+type metricsOVHClient struct {
+	client  OVHClient
+	metrics *metrics
+}
+
+func (c *metricsOVHClient) GetWithContext(ctx context.Context, url string, resType any) error {
+	err := c.client.GetWithContext(ctx, url, resType)
+	c.metrics.observeOVHRequest(http.MethodGet, err)
+	return err
+}
+
+func (c *metricsOVHClient) PostWithContext(ctx context.Context, url string, reqBody, resType any) error {
+	err := c.client.PostWithContext(ctx, url, reqBody, resType)
+	c.metrics.observeOVHRequest(http.MethodPost, err)
+	return err
+}
+
+func (c *metricsOVHClient) PutWithContext(ctx context.Context, url string, reqBody, resType any) error {
+	err := c.client.PutWithContext(ctx, url, reqBody, resType)
+	c.metrics.observeOVHRequest(http.MethodPut, err)
+	return err
+}
+
+func (c *metricsOVHClient) DeleteWithContext(ctx context.Context, url string, resType any) error {
+	err := c.client.DeleteWithContext(ctx, url, resType)
+	c.metrics.observeOVHRequest(http.MethodDelete, err)
+	return err
+}
+
+// startMetrics serves the metrics on the metrics_listen address, if any,
+// until the context is done.
+func (a *app) startMetrics(ctx context.Context) error {
+	if a.config.MetricsListen == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", a.metrics)
+	return startHTTPServer(ctx, a.config.MetricsListen, mux, "metrics")
+}
+
+// startHTTPServer listens on the address and serves the handler in the
+// background until the context is done.
+func startHTTPServer(ctx context.Context, addr string, handler http.Handler, name string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	go srv.Serve(ln)
+
+	slog.Info("serving "+name, "addr", ln.Addr().String())
+	return nil
+}
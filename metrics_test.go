@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+)
+
+func TestMetricLabels(t *testing.T) {
+	got := metricLabels("hostname", `a"b\c`, "type", "A\n")
+	want := `{hostname="a\"b\\c",type="A\n"}`
+	if got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestMetricsWriteTo(t *testing.T) {
+	m := newMetrics()
+	provider := ipSource{URL: "https://ip.example.net"}
+	m.observeIPProvider(provider, recordTypeA, 80*time.Millisecond, nil)
+	m.observeIPProvider(provider, recordTypeA, 3*time.Second, fmt.Errorf("timeout"))
+	m.observeDNSLookup("home.example.com", recordTypeA, "mismatch")
+	m.observeOVHRequest("GET", nil)
+	m.observeOVHRequest("PUT", &ovh.APIError{Code: 403})
+	m.observeOVHRequest("PUT", fmt.Errorf("connection refused"))
+	m.observeUpdate("home.example.com", recordTypeA, "success")
+	m.setLastSuccess("home.example.com", time.Unix(1700000000, 0))
+	m.setPublished("home.example.com", netip.MustParseAddr("203.0.113.1"))
+	m.setPublished("home.example.com", netip.MustParseAddr("203.0.113.2"))
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	got := rec.Body.String()
+
+	for _, want := range []string{
+		"# TYPE waybackd_ip_provider_request_duration_seconds histogram\n",
+		`waybackd_ip_provider_request_duration_seconds_bucket{provider="https://ip.example.net",type="A",le="0.05"} 0` + "\n",
+		`waybackd_ip_provider_request_duration_seconds_bucket{provider="https://ip.example.net",type="A",le="0.1"} 1` + "\n",
+		`waybackd_ip_provider_request_duration_seconds_bucket{provider="https://ip.example.net",type="A",le="5"} 2` + "\n",
+		`waybackd_ip_provider_request_duration_seconds_bucket{provider="https://ip.example.net",type="A",le="+Inf"} 2` + "\n",
+		`waybackd_ip_provider_request_duration_seconds_sum{provider="https://ip.example.net",type="A"} 3.08` + "\n",
+		`waybackd_ip_provider_request_duration_seconds_count{provider="https://ip.example.net",type="A"} 2` + "\n",
+		`waybackd_ip_provider_errors_total{provider="https://ip.example.net",type="A"} 1` + "\n",
+		`waybackd_dns_lookups_total{hostname="home.example.com",type="A",result="mismatch"} 1` + "\n",
+		`waybackd_ovh_api_requests_total{method="GET",status="200"} 1` + "\n",
+		`waybackd_ovh_api_requests_total{method="PUT",status="403"} 1` + "\n",
+		`waybackd_ovh_api_requests_total{method="PUT",status="error"} 1` + "\n",
+		`waybackd_record_updates_total{hostname="home.example.com",type="A",result="success"} 1` + "\n",
+		`waybackd_last_success_timestamp_seconds{hostname="home.example.com"} 1700000000` + "\n",
+		`waybackd_published_address_info{hostname="home.example.com",type="A",address="203.0.113.2"} 1` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+
+	if strings.Contains(got, "203.0.113.1") {
+		t.Errorf("expected the previous address to be replaced:\n%s", got)
+	}
+}
+
+func TestUpdateDomainsMetrics(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+	client := &mockOVHClient{
+		getFunc: func(url string, resType any) error {
+			if strings.Contains(url, "?") {
+				jsonInto([]int{42}, resType)
+			} else {
+				jsonInto(zoneRecord{ID: 42, FieldType: "A", Target: "198.51.100.1"}, resType)
+			}
+			return nil
+		},
+	}
+
+	m := newMetrics()
+	a := &app{
+		config:      config{Provider: testProviders, Domains: []domain{testDomain()}},
+		backends:    map[string]DNSBackend{backendOVH: &ovhBackend{client: &metricsOVHClient{client: client, metrics: m}}},
+		ipProvider:  &mockIPProvider{addr: ip},
+		dnsProvider: &mockDNSProvider{addr: netip.MustParseAddr("198.51.100.1")},
+		metrics:     m,
+		clock:       func() time.Time { return time.Unix(1700000000, 0) },
+	}
+
+	a.tryUpdateDomainsIfNeeded(context.Background())
+
+	var b strings.Builder
+	m.writeTo(&b)
+	got := b.String()
+
+	for _, want := range []string{
+		`waybackd_ip_provider_request_duration_seconds_count{provider="http://ip.example.net",type="A"} 1` + "\n",
+		`waybackd_dns_lookups_total{hostname="home.example.com",type="A",result="mismatch"} 1` + "\n",
+		`waybackd_ovh_api_requests_total{method="GET",status="200"} 2` + "\n",
+		`waybackd_ovh_api_requests_total{method="PUT",status="200"} 1` + "\n",
+		`waybackd_ovh_api_requests_total{method="POST",status="200"} 1` + "\n",
+		`waybackd_record_updates_total{hostname="home.example.com",type="A",result="success"} 1` + "\n",
+		`waybackd_last_success_timestamp_seconds{hostname="home.example.com"} 1700000000` + "\n",
+		`waybackd_published_address_info{hostname="home.example.com",type="A",address="203.0.113.1"} 1` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"time"
+)
+
+// rtnetlink message types, as defined in linux/rtnetlink.h.
+const (
+	netlinkHeaderSize = 16
+	rtmNewLink        = 16
+	rtmDelLink        = 17
+	rtmNewAddr        = 20
+	rtmDelAddr        = 21
+	rtmNewRoute       = 24
+	rtmDelRoute       = 25
+)
+
+const defaultNetworkDebounce = 5 * time.Second
+
+// NetworkWatcher notifies the changes of the local network configuration,
+// such as a new address after a PPPoE reconnect.
+type NetworkWatcher interface {
+	// Watch returns a channel receiving a value on each change. The channel
+	// is closed once the context is done or the watch fails.
+	Watch(ctx context.Context) (<-chan struct{}, error)
+}
+
+func (a *app) networkDebounce() time.Duration {
+	if a.config.NetworkDebounce <= 0 {
+		return defaultNetworkDebounce
+	}
+
+	return a.config.NetworkDebounce
+}
+
+// watchNetwork returns the channel notifying the network changes, or nil if
+// they cannot be watched, leaving the ticker alone.
+func (a *app) watchNetwork(ctx context.Context) <-chan struct{} {
+	if a.watcher == nil {
+		return nil
+	}
+
+	events, err := a.watcher.Watch(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to watch the network changes", "error", err)
+		return nil
+	}
+
+	return events
+}
+
+// netlinkChanged returns true if the rtnetlink messages report a change of
+// the links, addresses or routes.
+func netlinkChanged(buf []byte) bool {
+	for len(buf) >= netlinkHeaderSize {
+		size := int(binary.NativeEndian.Uint32(buf[0:4]))
+		if size < netlinkHeaderSize || size > len(buf) {
+			return false
+		}
+
+		switch binary.NativeEndian.Uint16(buf[4:6]) {
+		case rtmNewLink, rtmDelLink, rtmNewAddr, rtmDelAddr, rtmNewRoute, rtmDelRoute:
+			return true
+		}
+
+		// Messages are aligned to 4 bytes.
+		size = (size + 3) &^ 3
+		if size >= len(buf) {
+			return false
+		}
+		buf = buf[size:]
+	}
+
+	return false
+}
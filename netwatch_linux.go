@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+)
+
+// rtnetlink multicast groups, as defined in linux/rtnetlink.h.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6IfAddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+// netlinkWatcher subscribes to the rtnetlink multicast groups of the links,
+// addresses and routes.
+type netlinkWatcher struct{}
+
+func newNetworkWatcher() NetworkWatcher {
+	return &netlinkWatcher{}
+}
+
+func (w *netlinkWatcher) Watch(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink |
+			rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr |
+			rtmgrpIPv4Route | rtmgrpIPv6Route,
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	// A non blocking file uses the runtime poller, closing it unblocks the
+	// pending read.
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+	file := os.NewFile(uintptr(fd), "netlink")
+
+	events := make(chan struct{}, 1)
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+
+	go func() {
+		defer close(events)
+
+		buf := make([]byte, os.Getpagesize()*8)
+		for {
+			n, err := file.Read(buf)
+			switch {
+			case errors.Is(err, syscall.ENOBUFS):
+				// Some messages were dropped, assume they were changes.
+			case err != nil:
+				return
+			case !netlinkChanged(buf[:n]):
+				continue
+			}
+
+			// Pending events are merged, the update is debounced anyway.
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return events, nil
+}
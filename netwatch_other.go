@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// newNetworkWatcher is only implemented on linux, the domains are checked at
+// the check interval elsewhere.
+func newNetworkWatcher() NetworkWatcher {
+	return nil
+}
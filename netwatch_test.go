@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type mockNetworkWatcher struct {
+	events chan struct{}
+	err    error
+}
+
+func (m *mockNetworkWatcher) Watch(context.Context) (<-chan struct{}, error) {
+	return m.events, m.err
+}
+
+// netlinkMessage builds a rtnetlink message of the given type with a payload
+// of the given size.
+func netlinkMessage(t uint16, payload int) []byte {
+	msg := make([]byte, netlinkHeaderSize+payload)
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:6], t)
+	for len(msg)%4 != 0 {
+		msg = append(msg, 0)
+	}
+	return msg
+}
+
+func TestNetlinkChanged(t *testing.T) {
+	const rtmNewNeigh = 28
+
+	tests := []struct {
+		name string
+		buf  []byte
+		want bool
+	}{
+		{
+			name: "new address",
+			buf:  netlinkMessage(rtmNewAddr, 24),
+			want: true,
+		},
+		{
+			name: "deleted route",
+			buf:  netlinkMessage(rtmDelRoute, 28),
+			want: true,
+		},
+		{
+			name: "neighbor only",
+			buf:  netlinkMessage(rtmNewNeigh, 12),
+		},
+		{
+			name: "change after an unaligned message",
+			buf:  append(netlinkMessage(rtmNewNeigh, 13), netlinkMessage(rtmNewLink, 16)...),
+			want: true,
+		},
+		{
+			name: "truncated",
+			buf:  netlinkMessage(rtmNewAddr, 24)[:netlinkHeaderSize-1],
+		},
+		{
+			name: "invalid length",
+			buf:  binary.NativeEndian.AppendUint32(nil, 1000),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := netlinkChanged(tc.buf); got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoopNetworkChanges(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+	dns := &mockDNSProvider{addr: ip}
+	watcher := &mockNetworkWatcher{events: make(chan struct{})}
+	a := &app{
+		config: config{
+			Provider:        testProviders,
+			CheckInterval:   time.Hour,
+			NetworkDebounce: 50 * time.Millisecond,
+			Domains:         []domain{testDomain()},
+		},
+		backends:    map[string]DNSBackend{defaultBackend: newMockBackend()},
+		ipProvider:  &mockIPProvider{addr: ip},
+		dnsProvider: dns,
+		watcher:     watcher,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.loop(ctx, nil)
+		close(done)
+	}()
+
+	lookups := func() int {
+		dns.mu.Lock()
+		defer dns.mu.Unlock()
+		return len(dns.lookups)
+	}
+	waitLookups := func(want int) error {
+		deadline := time.Now().Add(2 * time.Second)
+		for lookups() < want {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("got %d lookups, want %d", lookups(), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return nil
+	}
+
+	// The first check happens at startup.
+	if err := waitLookups(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// A burst of events triggers a single check.
+	for range 5 {
+		watcher.events <- struct{}{}
+	}
+	if err := waitLookups(2); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * a.networkDebounce())
+	if got := lookups(); got != 2 {
+		t.Fatalf("got %d lookups, want 2", got)
+	}
+
+	// The loop keeps running once the events stop, until canceled.
+	close(watcher.events)
+	select {
+	case <-done:
+		t.Fatal("the loop stopped with the events")
+	case <-time.After(3 * a.networkDebounce()):
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the loop did not stop")
+	}
+}
+
+func TestWatchNetworkError(t *testing.T) {
+	a := &app{watcher: &mockNetworkWatcher{err: fmt.Errorf("permission denied")}}
+	if events := a.watchNetwork(context.Background()); events != nil {
+		t.Fatal("expected no events")
+	}
+}
@@ -1,53 +1,105 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net/netip"
+	"net/http"
 	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
 )
 
 type OVHClient interface {
-	Get(url string, resType any) error
-	Post(url string, reqBody, resType any) error
-	Put(url string, reqBody, resType any) error
+	GetWithContext(ctx context.Context, url string, resType any) error
+	PostWithContext(ctx context.Context, url string, reqBody, resType any) error
+	PutWithContext(ctx context.Context, url string, reqBody, resType any) error
+	DeleteWithContext(ctx context.Context, url string, resType any) error
+}
+
+type ovhConfig struct {
+	ApplicationKey    string `yaml:"application_key"`
+	ApplicationSecret string `yaml:"application_secret"`
+	ConsumerKey       string `yaml:"consumer_key"`
+	Endpoint          string `yaml:"endpoint"`
 }
 
 type zoneRecord struct {
+	ID        int    `json:"id,omitempty"`
 	FieldType string `json:"fieldType"`
 	Subdomain string `json:"subDomain"`
 	TTL       uint   `json:"ttl"`
 	Target    string `json:"target"`
 }
 
-func newZoneRecord(d domain, ip string) *zoneRecord {
+func newZoneRecord(d domain, r record) *zoneRecord {
 	return &zoneRecord{
 		Subdomain: d.SubDomain,
-		TTL:       uint(d.TTL.Seconds()),
-		FieldType: "A",
-		Target:    ip,
+		TTL:       uint(r.TTL.Seconds()),
+		FieldType: string(r.Type),
+		Target:    r.Target,
+	}
+}
+
+// ovhBackend manages the records using the OVH API.
+type ovhBackend struct {
+	client OVHClient
+}
+
+// newOVHBackend returns a backend recording its API calls in the metrics.
+func newOVHBackend(cfg ovhConfig, m *metrics) (*ovhBackend, error) {
+	client, err := ovh.NewClient(
+		cfg.Endpoint, cfg.ApplicationKey,
+		cfg.ApplicationSecret, cfg.ConsumerKey)
+	if err != nil {
+		return nil, err
 	}
+
+	return &ovhBackend{client: &metricsOVHClient{client: client, metrics: m}}, nil
 }
 
-func (a *app) refreshZoneRecord(d domain) error {
-	url := "/domain/zone/" + d.Domain + "/refresh"
-	if err := a.client.Post(url, nil, nil); err != nil {
-		return fmt.Errorf("failed to refresh the zone: %w", err)
+// ovhError marks the API errors retrying would not fix as permanent, such as
+// an invalid request or a consumer key without the required access.
+func ovhError(err error) error {
+	var apiErr *ovh.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+			return permanent(err)
+		}
+	}
+
+	return err
+}
+
+// StableIDs marks the OVH record IDs as kept across updates.
+func (b *ovhBackend) StableIDs() {}
+
+func recordURL(d domain, id string) string {
+	return "/domain/zone/" + d.Domain + "/record/" + id
+}
+
+func (b *ovhBackend) Refresh(ctx context.Context, zone string) error {
+	url := "/domain/zone/" + zone + "/refresh"
+	if err := b.client.PostWithContext(ctx, url, nil, nil); err != nil {
+		return fmt.Errorf("failed to refresh the zone: %w", ovhError(err))
 	}
 
-	fmt.Printf("%s: DNS zone refreshed\n", d.hostname())
 	return nil
 }
 
-func (a *app) fetchZoneRecordID(d domain) (int, error) {
+func (b *ovhBackend) fetchZoneRecordID(ctx context.Context, d domain, t recordType) (int, error) {
 	baseURL := "/domain/zone/" + d.Domain
 
 	v := url.Values{}
-	v.Add("fieldType", "A")
+	v.Add("fieldType", string(t))
 	v.Add("subDomain", d.SubDomain)
 	url := fmt.Sprintf("%s/record?%s", baseURL, v.Encode())
 	recordIDs := []int{}
-	if err := a.client.Get(url, &recordIDs); err != nil {
-		return 0, err
+	if err := b.client.GetWithContext(ctx, url, &recordIDs); err != nil {
+		return 0, ovhError(err)
 	}
 
 	switch len(recordIDs) {
@@ -56,47 +108,110 @@ func (a *app) fetchZoneRecordID(d domain) (int, error) {
 	case 1:
 		return recordIDs[0], nil
 	default:
-		return 0, fmt.Errorf("multiple ids for this record, something's wrong")
+		return 0, permanent(fmt.Errorf("multiple ids for this record, something's wrong"))
 	}
 }
 
-func (a *app) updateZoneRecord(d domain, ip netip.Addr) (*zoneRecord, error) {
-	baseURL := "/domain/zone/" + d.Domain + "/record"
-
-	id, err := a.fetchZoneRecordID(d)
+func (b *ovhBackend) Find(ctx context.Context, d domain, t recordType) (*record, error) {
+	id, err := b.fetchZoneRecordID(ctx, d, t)
 	if err != nil {
 		return nil, err
 	}
 
-	var record *zoneRecord
 	if id == 0 {
-		fmt.Printf("%s: creating a new zone record...\n", d.hostname())
-		record = newZoneRecord(d, ip.String())
-		if err := a.client.Post(baseURL, record, record); err != nil {
-			return nil, fmt.Errorf("failed to create the zone record: %w", err)
-		}
-	} else {
-		record = &zoneRecord{}
+		return nil, nil
+	}
+
+	zr := &zoneRecord{}
+	if err := b.client.GetWithContext(ctx, recordURL(d, strconv.Itoa(id)), zr); err != nil {
+		return nil, fmt.Errorf("failed to get the zone record: %w", ovhError(err))
+	}
 
-		url := fmt.Sprintf("%s/%d", baseURL, id)
-		if err := a.client.Get(url, record); err != nil {
-			return nil, fmt.Errorf("failed to get the zone record: %w", err)
+	return &record{
+		ID:     strconv.Itoa(id),
+		Type:   recordType(zr.FieldType),
+		Target: zr.Target,
+		TTL:    time.Duration(zr.TTL) * time.Second,
+	}, nil
+}
+
+func (b *ovhBackend) Create(ctx context.Context, d domain, r record) error {
+	url := "/domain/zone/" + d.Domain + "/record"
+	zr := newZoneRecord(d, r)
+	if err := b.client.PostWithContext(ctx, url, zr, zr); err != nil {
+		return fmt.Errorf("failed to create the zone record: %w", ovhError(err))
+	}
+
+	return nil
+}
+
+// ListZone fetches the records of the zone using its export.
+func (b *ovhBackend) ListZone(ctx context.Context, zone string) ([]namedRecord, error) {
+	var export string
+	if err := b.client.GetWithContext(ctx, "/domain/zone/"+zone+"/export", &export); err != nil {
+		return nil, fmt.Errorf("failed to export the zone: %w", ovhError(err))
+	}
+
+	return parseZoneFile(zone, export)
+}
+
+// Update replaces the record, its ID is looked up if unknown.
+func (b *ovhBackend) Update(ctx context.Context, d domain, r record) error {
+	if r.ID == "" {
+		id, err := b.fetchZoneRecordID(ctx, d, r.Type)
+		if err != nil {
+			return err
 		}
 
-		if record.Target == ip.String() {
-			fmt.Printf("%s: DNS target is already good\n", d.hostname())
-			return record, nil
+		if id == 0 {
+			return fmt.Errorf("no %s record to update", r.Type)
 		}
+		r.ID = strconv.Itoa(id)
+	}
 
-		fmt.Printf("%s: IP %s does not match the current DNS target %s, updating...\n",
-			d.hostname(), ip, record.Target)
+	if err := b.client.PutWithContext(ctx, recordURL(d, r.ID), newZoneRecord(d, r), nil); err != nil {
+		return fmt.Errorf("failed to update the zone record: %w", ovhError(err))
+	}
 
-		record = newZoneRecord(d, ip.String())
-		if err := a.client.Put(url, record, nil); err != nil {
-			return nil, fmt.Errorf("failed to update the zone record: %w", err)
-		}
+	return nil
+}
+
+func (b *ovhBackend) Delete(ctx context.Context, d domain, r record) error {
+	if err := b.client.DeleteWithContext(ctx, recordURL(d, r.ID), nil); err != nil {
+		return fmt.Errorf("failed to delete the zone record: %w", ovhError(err))
+	}
+
+	return nil
+}
+
+// runOVHSetup requests a consumer key allowed to manage the records of the
+// given zones.
+func runOVHSetup(cfg ovhConfig, zones []string) error {
+	client, err := ovh.NewClient(
+		cfg.Endpoint, cfg.ApplicationKey,
+		cfg.ApplicationSecret, "")
+	if err != nil {
+		return err
 	}
 
-	err = a.refreshZoneRecord(d)
-	return record, err
+	ckReq := client.NewCkRequest()
+	for _, zone := range zones {
+		zone := "/domain/zone/" + zone
+		ckReq.AddRule("GET", zone+"/record")
+		ckReq.AddRule("GET", zone+"/export")
+		ckReq.AddRule("POST", zone+"/record")
+		ckReq.AddRule("POST", zone+"/refresh")
+		ckReq.AddRule("GET", zone+"/record/*")
+		ckReq.AddRule("PUT", zone+"/record/*")
+		ckReq.AddRule("DELETE", zone+"/record/*")
+	}
+
+	state, err := ckReq.Do()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Consumer key: %s\n", state.ConsumerKey)
+	fmt.Printf("Validation URL: %s\n", state.ValidationURL)
+	return nil
 }
@@ -1,47 +1,86 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/netip"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 type mockOVHClient struct {
-	getCalls  []string
-	postCalls []string
-	putCalls  []string
+	mu          sync.Mutex
+	getCalls    []string
+	postCalls   []string
+	putCalls    []string
+	deleteCalls []string
 
-	getFunc  func(url string, resType any) error
-	postFunc func(url string, reqBody, resType any) error
-	putFunc  func(url string, reqBody, resType any) error
+	getFunc    func(url string, resType any) error
+	postFunc   func(url string, reqBody, resType any) error
+	putFunc    func(url string, reqBody, resType any) error
+	deleteFunc func(url string, resType any) error
 }
 
-func (m *mockOVHClient) Get(url string, resType any) error {
+func (m *mockOVHClient) GetWithContext(ctx context.Context, url string, resType any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	m.getCalls = append(m.getCalls, url)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if m.getFunc != nil {
 		return m.getFunc(url, resType)
 	}
 	return nil
 }
 
-func (m *mockOVHClient) Post(url string, reqBody, resType any) error {
+func (m *mockOVHClient) PostWithContext(ctx context.Context, url string, reqBody, resType any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	m.postCalls = append(m.postCalls, url)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if m.postFunc != nil {
 		return m.postFunc(url, reqBody, resType)
 	}
 	return nil
 }
 
-func (m *mockOVHClient) Put(url string, reqBody, resType any) error {
+func (m *mockOVHClient) PutWithContext(ctx context.Context, url string, reqBody, resType any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	m.putCalls = append(m.putCalls, url)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if m.putFunc != nil {
 		return m.putFunc(url, reqBody, resType)
 	}
 	return nil
 }
 
+func (m *mockOVHClient) DeleteWithContext(ctx context.Context, url string, resType any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteCalls = append(m.deleteCalls, url)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if m.deleteFunc != nil {
+		return m.deleteFunc(url, resType)
+	}
+	return nil
+}
+
 // jsonInto marshals src then unmarshals into dst, simulating how the OVH
 // client populates response types.
 func jsonInto(src, dst any) {
@@ -55,11 +94,15 @@ func testDomain() domain {
 
 func testApp(client *mockOVHClient) *app {
 	return &app{
-		config: config{Domains: []domain{testDomain()}},
-		client: client,
+		config:   config{Domains: []domain{testDomain()}},
+		backends: testBackends(client),
 	}
 }
 
+func testBackends(client *mockOVHClient) map[string]DNSBackend {
+	return map[string]DNSBackend{backendOVH: &ovhBackend{client: client}}
+}
+
 func TestFetchZoneRecordID(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -93,8 +136,8 @@ func TestFetchZoneRecordID(t *testing.T) {
 				},
 			}
 
-			a := testApp(mock)
-			id, err := a.fetchZoneRecordID(testDomain())
+			b := &ovhBackend{client: mock}
+			id, err := b.fetchZoneRecordID(context.Background(), testDomain(), recordTypeA)
 
 			if tc.wantErr {
 				if err == nil {
@@ -114,37 +157,68 @@ func TestFetchZoneRecordID(t *testing.T) {
 	}
 }
 
-func TestUpdateZoneRecord(t *testing.T) {
+func TestUpdateZonesOVH(t *testing.T) {
 	ip := netip.MustParseAddr("203.0.113.1")
 
+	// sent records the bodies of the POST and PUT calls.
+	sent := func(records *[]*zoneRecord) func(url string, reqBody, resType any) error {
+		return func(url string, reqBody, resType any) error {
+			if zr, ok := reqBody.(*zoneRecord); ok {
+				*records = append(*records, zr)
+			}
+			return nil
+		}
+	}
+
 	t.Run("create new record", func(t *testing.T) {
+		var created []*zoneRecord
 		mock := &mockOVHClient{
 			getFunc: func(url string, resType any) error {
 				// fetchZoneRecordID returns empty list
 				jsonInto([]int{}, resType)
 				return nil
 			},
+			postFunc: sent(&created),
 		}
 
-		a := testApp(mock)
-		record, err := a.updateZoneRecord(testDomain(), ip)
-		if err != nil {
+		if err := updateRecord(testApp(mock), testDomain(), ip); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 
-		if record.Target != ip.String() {
-			t.Fatalf("got target %s, want %s", record.Target, ip)
-		}
-		if record.FieldType != "A" {
-			t.Fatalf("got field type %s, want A", record.FieldType)
-		}
 		if len(mock.postCalls) != 2 {
 			t.Fatalf("expected 2 POST calls (create + refresh), got %d", len(mock.postCalls))
 		}
+		if len(created) != 1 || created[0].Target != ip.String() || created[0].FieldType != "A" {
+			t.Fatalf("unexpected records created: %+v", created)
+		}
+	})
+
+	t.Run("create new AAAA record", func(t *testing.T) {
+		ip6 := netip.MustParseAddr("2001:db8::1")
+		var created []*zoneRecord
+		mock := &mockOVHClient{
+			getFunc: func(url string, resType any) error {
+				jsonInto([]int{}, resType)
+				return nil
+			},
+			postFunc: sent(&created),
+		}
+
+		if err := updateRecord(testApp(mock), testDomain(), ip6); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(created) != 1 || created[0].FieldType != "AAAA" {
+			t.Fatalf("unexpected records created: %+v", created)
+		}
+		if !strings.Contains(mock.getCalls[0], "fieldType=AAAA") {
+			t.Fatalf("expected an AAAA record lookup, got %s", mock.getCalls[0])
+		}
 	})
 
 	t.Run("update existing record", func(t *testing.T) {
 		callNum := 0
+		var updated []*zoneRecord
 		mock := &mockOVHClient{
 			getFunc: func(url string, resType any) error {
 				callNum++
@@ -163,19 +237,21 @@ func TestUpdateZoneRecord(t *testing.T) {
 				}
 				return nil
 			},
+			putFunc: sent(&updated),
 		}
 
-		a := testApp(mock)
-		record, err := a.updateZoneRecord(testDomain(), ip)
-		if err != nil {
+		if err := updateRecord(testApp(mock), testDomain(), ip); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 
-		if record.Target != ip.String() {
-			t.Fatalf("got target %s, want %s", record.Target, ip)
+		if len(mock.putCalls) != 1 || mock.putCalls[0] != "/domain/zone/example.com/record/42" {
+			t.Fatalf("expected 1 PUT call of record 42, got %v", mock.putCalls)
+		}
+		if len(updated) != 1 || updated[0].Target != ip.String() {
+			t.Fatalf("unexpected records updated: %+v", updated)
 		}
-		if len(mock.putCalls) != 1 {
-			t.Fatalf("expected 1 PUT call, got %d", len(mock.putCalls))
+		if len(mock.postCalls) != 1 {
+			t.Fatalf("expected 1 POST call (refresh), got %d", len(mock.postCalls))
 		}
 	})
 
@@ -199,15 +275,10 @@ func TestUpdateZoneRecord(t *testing.T) {
 			},
 		}
 
-		a := testApp(mock)
-		record, err := a.updateZoneRecord(testDomain(), ip)
-		if err != nil {
+		if err := updateRecord(testApp(mock), testDomain(), ip); err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 
-		if record.Target != ip.String() {
-			t.Fatalf("got target %s, want %s", record.Target, ip)
-		}
 		if len(mock.putCalls) != 0 {
 			t.Fatalf("expected 0 PUT calls, got %d", len(mock.putCalls))
 		}
@@ -223,10 +294,27 @@ func TestUpdateZoneRecord(t *testing.T) {
 			},
 		}
 
-		a := testApp(mock)
-		_, err := a.updateZoneRecord(testDomain(), ip)
-		if err == nil {
+		if err := updateRecord(testApp(mock), testDomain(), ip); err == nil {
 			t.Fatal("expected error, got nil")
 		}
 	})
 }
+
+func TestOVHBackendContext(t *testing.T) {
+	mock := &mockOVHClient{}
+	b := &ovhBackend{client: &metricsOVHClient{client: mock}}
+
+	// The timeouts and the cancellation reach the API calls.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := b.Find(ctx, testDomain(), recordTypeA); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	if err := b.Refresh(ctx, "example.com"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	if len(mock.getCalls) != 1 || len(mock.postCalls) != 1 {
+		t.Fatalf("got calls %v %v", mock.getCalls, mock.postCalls)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultParallelism   = 4
+	defaultDomainTimeout = time.Minute
+)
+
+func (a *app) parallelism() int {
+	if a.config.Parallelism <= 0 {
+		return defaultParallelism
+	}
+
+	return a.config.Parallelism
+}
+
+func (a *app) domainTimeout() time.Duration {
+	if a.config.DomainTimeout <= 0 {
+		return defaultDomainTimeout
+	}
+
+	return a.config.DomainTimeout
+}
+
+// runTasks runs the n tasks using at most a.parallelism() goroutines, each
+// one with its own timeout unless it is zero. The lines logged by each task
+// are printed in the order of the tasks, as soon as the previous ones are
+// done.
+func (a *app) runTasks(ctx context.Context, n int, timeout time.Duration, task func(ctx context.Context, i int)) {
+	buffers := make([]*logBuffer, n)
+	done := make([]chan struct{}, n)
+	for i := range n {
+		done[i] = make(chan struct{})
+	}
+
+	sem := make(chan struct{}, a.parallelism())
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[i])
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			taskCtx, buf := withLogBuffer(ctx)
+			buffers[i] = buf
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				taskCtx, cancel = context.WithTimeout(taskCtx, timeout)
+				defer cancel()
+			}
+
+			task(taskCtx, i)
+		}()
+	}
+
+	for i := range n {
+		<-done[i]
+		buffers[i].flush()
+	}
+
+	wg.Wait()
+}
+
+// lockZone prevents concurrent updates of the zone, the returned function
+// releases the lock.
+func (a *app) lockZone(k zoneKey) func() {
+	v, _ := a.zoneLocks.LoadOrStore(k, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
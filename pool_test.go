@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunTasks(t *testing.T) {
+	tests := []struct {
+		name        string
+		parallelism int
+		tasks       int
+	}{
+		{name: "default parallelism", tasks: 10},
+		{name: "sequential", parallelism: 1, tasks: 5},
+		{name: "more workers than tasks", parallelism: 8, tasks: 3},
+		{name: "no tasks", parallelism: 2},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &app{config: config{Parallelism: tc.parallelism}}
+
+			var out bytes.Buffer
+			logger := slog.New(&bufferHandler{Handler: slog.NewTextHandler(&out, &slog.HandlerOptions{
+				ReplaceAttr: testLogWithoutTime,
+			})})
+			var running, maxRunning atomic.Int32
+			a.runTasks(context.Background(), tc.tasks, time.Second, func(ctx context.Context, i int) {
+				n := running.Add(1)
+				defer running.Add(-1)
+				for {
+					m := maxRunning.Load()
+					if n <= m || maxRunning.CompareAndSwap(m, n) {
+						break
+					}
+				}
+
+				if _, ok := ctx.Deadline(); !ok {
+					t.Error("expected a task deadline")
+				}
+
+				// The last tasks finish first.
+				time.Sleep(time.Duration(tc.tasks-i) * time.Millisecond)
+				logger.InfoContext(ctx, "start", "task", i)
+				logger.InfoContext(ctx, "done", "task", i)
+			})
+
+			var want bytes.Buffer
+			for i := range tc.tasks {
+				fmt.Fprintf(&want, "level=INFO msg=start task=%d\nlevel=INFO msg=done task=%d\n", i, i)
+			}
+
+			if out.String() != want.String() {
+				t.Fatalf("got logs:\n%s\nwant:\n%s", out.String(), want.String())
+			}
+
+			if int(maxRunning.Load()) > a.parallelism() {
+				t.Fatalf("got %d tasks running at once, want at most %d", maxRunning.Load(), a.parallelism())
+			}
+		})
+	}
+}
+
+func TestRunTasksTimeout(t *testing.T) {
+	a := &app{config: config{DomainTimeout: 10 * time.Millisecond}}
+
+	errs := make([]error, 2)
+	a.runTasks(context.Background(), 2, a.domainTimeout(), func(ctx context.Context, i int) {
+		select {
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+		case <-time.After(time.Second):
+		}
+	})
+
+	for i, err := range errs {
+		if err != context.DeadlineExceeded {
+			t.Fatalf("task %d: got %v, want %v", i, err, context.DeadlineExceeded)
+		}
+	}
+}
+
+func TestLockZone(t *testing.T) {
+	a := &app{}
+	k := zoneKey{backend: backendOVH, zone: "example.com"}
+
+	var running, maxRunning atomic.Int32
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer a.lockZone(k)()
+
+			n := running.Add(1)
+			defer running.Add(-1)
+			if n > maxRunning.Load() {
+				maxRunning.Store(n)
+			}
+			time.Sleep(time.Millisecond)
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning.Load() != 1 {
+		t.Fatalf("got %d updates of the zone at once, want 1", maxRunning.Load())
+	}
+
+	// Other zones are not blocked.
+	unlock := a.lockZone(k)
+	defer unlock()
+	a.lockZone(zoneKey{backend: backendOVH, zone: "example.org"})()
+}
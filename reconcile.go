@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"strings"
+)
+
+type reconcileMode string
+
+const (
+	// reconcileRecord looks up each hostname using the DNS provider, then
+	// fetches the records to change from the backend one by one.
+	reconcileRecord reconcileMode = "record"
+	// reconcileZone fetches all the records of each zone at once from the
+	// backend and compares them locally.
+	reconcileZone reconcileMode = "zone"
+)
+
+func (m reconcileMode) valid() bool {
+	return m == "" || m == reconcileRecord || m == reconcileZone
+}
+
+// zoneSnapshot holds the records of a zone fetched at once, keyed by
+// subdomain and type.
+type zoneSnapshot map[string][]record
+
+func zoneSnapshotKey(subDomain string, t recordType) string {
+	return strings.ToLower(subDomain) + "/" + string(t)
+}
+
+func newZoneSnapshot(records []namedRecord) zoneSnapshot {
+	s := zoneSnapshot{}
+	for _, r := range records {
+		key := zoneSnapshotKey(r.SubDomain, r.Type)
+		s[key] = append(s[key], r.record)
+	}
+
+	return s
+}
+
+// change returns the change publishing the address for the domain, and
+// false if the zone already holds it.
+func (s zoneSnapshot) change(ctx context.Context, d domain, ip netip.Addr) (recordChange, bool) {
+	c := recordChange{domain: d, ip: ip}
+	records := s[zoneSnapshotKey(d.SubDomain, recordTypeOf(ip))]
+	switch len(records) {
+	case 0:
+		c.known = true
+		slog.InfoContext(ctx, "zone record missing", "hostname", d.hostname(), "zone", d.Domain, "new_ip", ip)
+	case 1:
+		if records[0].Target == ip.String() {
+			return c, false
+		}
+
+		c.known = true
+		c.current = &records[0]
+		slog.InfoContext(ctx, "zone record out of date", "hostname", d.hostname(), "zone", d.Domain,
+			"old_ip", records[0].Target, "new_ip", ip)
+	default:
+		// Let the backend report the duplicated records.
+		slog.WarnContext(ctx, "multiple zone records", "hostname", d.hostname(), "zone", d.Domain,
+			"records", len(records), "new_ip", ip)
+	}
+
+	return c, true
+}
+
+// fetchZones returns the snapshots of the zones of the given domains managed
+// by a backend able to list them. The zones failing to be fetched are left
+// out.
+func (a *app) fetchZones(ctx context.Context, domains []domain) map[zoneKey]zoneSnapshot {
+	snapshots := map[zoneKey]zoneSnapshot{}
+	failed := map[zoneKey]bool{}
+	for _, d := range domains {
+		k := zoneKey{backend: d.backend(), zone: d.Domain}
+		if _, ok := snapshots[k]; ok || failed[k] {
+			continue
+		}
+
+		backend, err := a.backend(d)
+		if err != nil {
+			continue
+		}
+
+		lister, ok := backend.(ZoneLister)
+		if !ok {
+			continue
+		}
+
+		records, err := lister.ListZone(ctx, k.zone)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to fetch the zone", "zone", k.zone, "error", err)
+			failed[k] = true
+			continue
+		}
+
+		slog.InfoContext(ctx, "zone fetched", "zone", k.zone, "records", len(records))
+		snapshots[k] = newZoneSnapshot(records)
+	}
+
+	return snapshots
+}
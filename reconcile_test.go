@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconcileZone(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+	domains := []domain{
+		{Domain: "example.com", SubDomain: "home", TTL: time.Minute},
+		{Domain: "example.com", SubDomain: "nas", TTL: time.Minute},
+		{Domain: "example.com", SubDomain: "new", TTL: time.Minute},
+	}
+
+	tests := []struct {
+		name        string
+		exportErr   error
+		wantGets    []string
+		wantPuts    []string
+		wantPosts   []string
+		wantLookups int
+	}{
+		{
+			name: "only the differing records are fetched",
+			wantGets: []string{
+				"/domain/zone/example.com/export",
+				"/domain/zone/example.com/record?fieldType=A&subDomain=nas",
+			},
+			wantPuts: []string{"/domain/zone/example.com/record/42"},
+			wantPosts: []string{
+				"/domain/zone/example.com/record",
+				"/domain/zone/example.com/refresh",
+			},
+		},
+		{
+			name:      "export failure falls back to the DNS lookups",
+			exportErr: fmt.Errorf("403 forbidden"),
+			wantGets: []string{
+				"/domain/zone/example.com/export",
+				"/domain/zone/example.com/record?fieldType=A&subDomain=home",
+				"/domain/zone/example.com/record/41",
+				"/domain/zone/example.com/record?fieldType=A&subDomain=nas",
+				"/domain/zone/example.com/record/42",
+				"/domain/zone/example.com/record?fieldType=A&subDomain=new",
+			},
+			wantPuts: []string{"/domain/zone/example.com/record/42"},
+			wantPosts: []string{
+				"/domain/zone/example.com/record",
+				"/domain/zone/example.com/refresh",
+			},
+			wantLookups: 3,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			records := map[string]zoneRecord{
+				"home": {ID: 41, FieldType: "A", Subdomain: "home", TTL: 60, Target: ip.String()},
+				"nas":  {ID: 42, FieldType: "A", Subdomain: "nas", TTL: 60, Target: "198.51.100.1"},
+			}
+
+			mock := &mockOVHClient{
+				getFunc: func(url string, resType any) error {
+					switch {
+					case strings.HasSuffix(url, "/export"):
+						if tc.exportErr != nil {
+							return tc.exportErr
+						}
+						jsonInto("$TTL 60\nhome IN A 203.0.113.1\nnas IN A 198.51.100.1\nwww IN CNAME home\n", resType)
+					case strings.Contains(url, "subDomain="):
+						ids := []int{}
+						for sub, r := range records {
+							if strings.HasSuffix(url, "subDomain="+sub) {
+								ids = append(ids, r.ID)
+							}
+						}
+						jsonInto(ids, resType)
+					default:
+						for _, r := range records {
+							if strings.HasSuffix(url, fmt.Sprintf("/%d", r.ID)) {
+								jsonInto(r, resType)
+							}
+						}
+					}
+					return nil
+				},
+			}
+
+			// The resolver serves stale answers, only the lookups of the
+			// fallback are affected.
+			dns := &mockDNSProvider{addr: netip.MustParseAddr("198.51.100.1")}
+			a := &app{
+				config: config{
+					Provider:  testProviders,
+					Reconcile: reconcileZone,
+					Domains:   domains,
+				},
+				backends:    testBackends(mock),
+				ipProvider:  &mockIPProvider{addr: ip},
+				dnsProvider: dns,
+			}
+
+			a.tryUpdateDomainsIfNeeded(context.Background())
+
+			if fmt.Sprint(mock.getCalls) != fmt.Sprint(tc.wantGets) {
+				t.Fatalf("got GET calls %v, want %v", mock.getCalls, tc.wantGets)
+			}
+			if fmt.Sprint(mock.putCalls) != fmt.Sprint(tc.wantPuts) {
+				t.Fatalf("got PUT calls %v, want %v", mock.putCalls, tc.wantPuts)
+			}
+			if fmt.Sprint(mock.postCalls) != fmt.Sprint(tc.wantPosts) {
+				t.Fatalf("got POST calls %v, want %v", mock.postCalls, tc.wantPosts)
+			}
+			if len(dns.lookups) != tc.wantLookups {
+				t.Fatalf("got %d DNS lookups, want %d", len(dns.lookups), tc.wantLookups)
+			}
+		})
+	}
+}
+
+func TestReconcileZoneRetry(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+	home := domain{Domain: "example.com", SubDomain: "home", TTL: time.Minute}
+	nas := domain{Domain: "example.org", SubDomain: "nas", TTL: time.Minute}
+
+	mock := &mockOVHClient{
+		getFunc: func(url string, resType any) error {
+			if strings.HasSuffix(url, "/export") {
+				jsonInto("$TTL 60\nhome IN A 203.0.113.1\nnas IN A 203.0.113.1\n", resType)
+			}
+			return nil
+		},
+	}
+
+	state, err := loadState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &app{
+		config: config{
+			Provider:  testProviders,
+			Reconcile: reconcileZone,
+			Domains:   []domain{home, nas},
+		},
+		backends:    testBackends(mock),
+		ipProvider:  &mockIPProvider{addr: ip},
+		dnsProvider: &mockDNSProvider{addr: ip},
+		state:       state,
+	}
+
+	// A retry only fetches the zones of the domains retried.
+	a.updateDomains(context.Background(), []domain{nas})
+
+	want := []string{"/domain/zone/example.org/export"}
+	if fmt.Sprint(mock.getCalls) != fmt.Sprint(want) {
+		t.Fatalf("got GET calls %v, want %v", mock.getCalls, want)
+	}
+
+	// The record already up to date is kept in the state.
+	if p, ok := a.state.published(nas.hostname(), recordTypeA); !ok || p.IP != ip {
+		t.Fatalf("got published %+v, want %s", p, ip)
+	}
+}
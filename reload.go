@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// reload parses the configuration file again and applies it, the running
+// configuration being kept if the new one is invalid. It returns true if the
+// configuration was replaced.
+func (a *app) reload() bool {
+	slog.Info("reloading the configuration", "path", a.configPath)
+
+	cfg, err := parseConfig(a.configPath)
+	if err == nil && len(cfg.Provider) == 0 {
+		err = fmt.Errorf("no IP provider configured")
+	}
+	if err == nil {
+		err = a.applyReload(cfg)
+	}
+	if err != nil {
+		slog.Error("failed to reload the configuration, keeping the running one", "error", err)
+		return false
+	}
+
+	slog.Info("configuration reloaded", "domains", len(a.config.Domains), "check_interval", a.config.CheckInterval)
+	return true
+}
+
+// applyReload applies the new configuration, then logs the domains added and
+// removed and forgets the retries of the removed ones.
+func (a *app) applyReload(cfg config) error {
+	previous := hostnames(a.config.Domains)
+	if err := a.apply(cfg); err != nil {
+		return err
+	}
+
+	current := hostnames(a.config.Domains)
+	for _, hostname := range current {
+		if !slices.Contains(previous, hostname) {
+			slog.Info("domain added", "hostname", hostname)
+		}
+	}
+
+	var removed []string
+	for _, hostname := range previous {
+		if !slices.Contains(current, hostname) {
+			slog.Info("domain removed", "hostname", hostname)
+			removed = append(removed, hostname)
+		}
+	}
+
+	a.retryMu.Lock()
+	for _, hostname := range removed {
+		delete(a.retries, hostname)
+	}
+	a.retryMu.Unlock()
+
+	return nil
+}
+
+// hostnames returns the hostnames of the domains, without duplicates.
+func hostnames(domains []domain) []string {
+	var names []string
+	for _, d := range domains {
+		if !slices.Contains(names, d.hostname()) {
+			names = append(names, d.hostname())
+		}
+	}
+
+	return names
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testReloadConfig(consumerKey, interval string, subDomains ...string) string {
+	text := fmt.Sprintf(`provider: http://ip.example.net
+check_interval: %s
+ovh:
+  endpoint: ovh-eu
+  application_key: key
+  application_secret: secret
+  consumer_key: %s
+domains:
+`, interval, consumerKey)
+	for _, sub := range subDomains {
+		text += fmt.Sprintf("  - domain: example.com\n    sub_domain: %s\n    ttl: 60s\n", sub)
+	}
+
+	return text
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(text string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(testReloadConfig("ck1", "1m", "a", "b"))
+	a, err := newApp(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.recordResult(t.Context(), domain{Domain: "example.com", SubDomain: "a"}, fmt.Errorf("timeout"))
+	a.recordResult(t.Context(), domain{Domain: "example.com", SubDomain: "b"}, fmt.Errorf("timeout"))
+	backend := a.backends[backendOVH]
+
+	write(testReloadConfig("ck2", "2m", "a", "c"))
+	if !a.reload() {
+		t.Fatal("expected the configuration to be reloaded")
+	}
+
+	if got := hostnames(a.config.Domains); !slices.Equal(got, []string{"a.example.com", "c.example.com"}) {
+		t.Fatalf("got domains %v", got)
+	}
+	if a.config.CheckInterval != 2*time.Minute {
+		t.Fatalf("got check interval %s, want 2m", a.config.CheckInterval)
+	}
+	if a.config.OVH.ConsumerKey != "ck2" || a.backends[backendOVH] == backend {
+		t.Fatal("expected a new OVH backend")
+	}
+	if _, ok := a.retries["b.example.com"]; ok {
+		t.Fatal("expected the retries of the removed domain to be forgotten")
+	}
+	if _, ok := a.retries["a.example.com"]; !ok {
+		t.Fatal("expected the retries of the kept domain to be kept")
+	}
+
+	tests := []struct {
+		name string
+		text string
+	}{
+		{name: "invalid yaml", text: "domains: ["},
+		{name: "unsupported provider", text: testReloadConfig("ck3", "1m", "a") + "    provider: unknown\n"},
+		{name: "no IP provider", text: "domains:\n  - domain: example.com\n    sub_domain: a\n"},
+		{name: "no domains", text: testReloadConfig("ck3", "1m")},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			write(tc.text)
+			if a.reload() {
+				t.Fatal("expected the reload to fail")
+			}
+
+			if got := hostnames(a.config.Domains); !slices.Equal(got, []string{"a.example.com", "c.example.com"}) {
+				t.Fatalf("got domains %v, want the running ones", got)
+			}
+			if a.config.OVH.ConsumerKey != "ck2" {
+				t.Fatalf("got consumer key %s, want the running one", a.config.OVH.ConsumerKey)
+			}
+		})
+	}
+}
+
+func TestReloadDynDNS2(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(password string) {
+		t.Helper()
+		text := `provider: http://ip.example.net
+dyndns2:
+  url: https://www.ovh.com/nic/update?system=dyndns
+  username: user
+domains:
+  - domain: example.com
+    sub_domain: home
+    ttl: 60s
+    provider: dyndns2
+    dyndns2:
+      password: %s
+`
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(text, password)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("secret")
+	a, err := newApp(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := a.config.Domains[0]
+	old := a.backends[backendDynDNS2].(*dyndns2Backend)
+	old.targets[dyndns2Key(d, recordTypeA)] = "203.0.113.1"
+	old.fatal[d.hostname()] = dyndns2Disabled{
+		err:    permanent(errDynDNS2Fatal),
+		config: old.config.merge(d.DynDNS2),
+	}
+
+	tests := []struct {
+		name      string
+		password  string
+		wantFatal bool
+	}{
+		// The hostname refused by the server stays disabled.
+		{name: "same configuration", password: "secret", wantFatal: true},
+		// A fixed password enables the hostname again.
+		{name: "new password", password: "fixed"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			write(tc.password)
+			if !a.reload() {
+				t.Fatal("expected the configuration to be reloaded")
+			}
+
+			b := a.backends[backendDynDNS2].(*dyndns2Backend)
+			if b == old {
+				t.Fatal("expected a new dyndns2 backend")
+			}
+			_, err := b.Find(t.Context(), a.config.Domains[0], recordTypeA)
+			if got := errors.Is(err, errDynDNS2Fatal); got != tc.wantFatal {
+				t.Fatalf("got fatal %v, want %v: %v", got, tc.wantFatal, err)
+			}
+			if got := b.targets[dyndns2Key(d, recordTypeA)]; got != "203.0.113.1" {
+				t.Fatalf("got target %q, want the one pushed", got)
+			}
+		})
+	}
+}
+
+func TestReloadWebhooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(url string) {
+		t.Helper()
+		text := testReloadConfig("ck", "1m", "a") + "webhooks:\n  - url: " + url + "\n"
+		if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("https://ntfy.sh/before")
+	a, err := newApp(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := a.webhooks
+
+	write("https://ntfy.sh/after")
+	if !a.reload() {
+		t.Fatal("expected the configuration to be reloaded")
+	}
+
+	// The notifier is kept, the deliveries started before the reload are
+	// waited for on exit.
+	if a.webhooks != n {
+		t.Fatal("expected the webhook notifier to be kept")
+	}
+	if len(n.hooks) != 1 || n.hooks[0].URL != "https://ntfy.sh/after" {
+		t.Fatalf("got webhooks %+v", n.hooks)
+	}
+}
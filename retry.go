@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	defaultRetryInterval    = 30 * time.Second
+	defaultRetryMaxAttempts = 5
+	// retryJitter is the maximum variation applied to the backoff, as a
+	// fraction of it.
+	retryJitter = 0.2
+	// retryMaxShift caps the growth of the backoff.
+	retryMaxShift = 10
+)
+
+// permanentError is an error retrying would not fix, such as a refused
+// authentication.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// permanent marks the error as permanent.
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &permanentError{err: err}
+}
+
+// isPermanent returns true if the error, or an error it wraps, is permanent.
+// The other errors, such as DNS timeouts, are transient.
+func isPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// retryState tracks the failed attempts of a domain.
+type retryState struct {
+	attempts int
+	next     time.Time
+	err      error
+}
+
+func (a *app) retryInterval() time.Duration {
+	if a.config.RetryInterval <= 0 {
+		return defaultRetryInterval
+	}
+
+	return a.config.RetryInterval
+}
+
+func (a *app) retryMaxAttempts() int {
+	if a.config.RetryMaxAttempts <= 0 {
+		return defaultRetryMaxAttempts
+	}
+
+	return a.config.RetryMaxAttempts
+}
+
+// backoff returns the delay before the next attempt once the given number
+// of attempts failed: the retry interval doubled after each failure, with
+// some jitter to spread the retries.
+func (a *app) backoff(attempts int) time.Duration {
+	shift := min(max(attempts-1, 0), retryMaxShift)
+	d := a.retryInterval() << shift
+	jitter := (rand.Float64()*2 - 1) * retryJitter
+	return d + time.Duration(float64(d)*jitter)
+}
+
+// recordResult updates the retry state of the domain after an attempt,
+// scheduling a retry if the error is transient.
+func (a *app) recordResult(ctx context.Context, d domain, err error) {
+	a.retryMu.Lock()
+	defer a.retryMu.Unlock()
+
+	hostname := d.hostname()
+	a.state.setError(hostname, err, a.now())
+	a.status.setError(hostname, err, a.now())
+	if err == nil {
+		a.metrics.setLastSuccess(hostname, a.now())
+		delete(a.retries, hostname)
+		return
+	}
+
+	if a.retries == nil {
+		a.retries = map[string]*retryState{}
+	}
+
+	state, ok := a.retries[hostname]
+	if !ok {
+		state = &retryState{}
+		a.retries[hostname] = state
+	}
+	state.attempts++
+	state.err = err
+	state.next = time.Time{}
+
+	a.webhooks.notify(ctx, webhookEvent{
+		Event:    webhookEventFailure,
+		Hostname: hostname,
+		Time:     a.now(),
+		Result:   "failure",
+		Error:    err.Error(),
+		Failures: state.attempts,
+	})
+
+	switch {
+	case isPermanent(err):
+		slog.ErrorContext(ctx, "permanent error, waiting for the next check", "hostname", hostname)
+	case state.attempts >= a.retryMaxAttempts():
+		slog.ErrorContext(ctx, "giving up, waiting for the next check", "hostname", hostname, "attempts", state.attempts)
+	default:
+		delay := a.backoff(state.attempts)
+		state.next = a.now().Add(delay)
+		slog.InfoContext(ctx, "retrying", "hostname", hostname, "delay", delay.Round(time.Second),
+			"attempt", state.attempts+1, "max_attempts", a.retryMaxAttempts())
+	}
+}
+
+// dueRetries returns the domains whose retry is due.
+func (a *app) dueRetries() []domain {
+	a.retryMu.Lock()
+	defer a.retryMu.Unlock()
+
+	now := a.now()
+	var domains []domain
+	for _, d := range a.config.Domains {
+		state, ok := a.retries[d.hostname()]
+		if ok && !state.next.IsZero() && !state.next.After(now) {
+			domains = append(domains, d)
+		}
+	}
+
+	return domains
+}
+
+// nextRetry returns the time of the earliest retry scheduled, if any.
+func (a *app) nextRetry() (time.Time, bool) {
+	a.retryMu.Lock()
+	defer a.retryMu.Unlock()
+
+	var next time.Time
+	for _, state := range a.retries {
+		if !state.next.IsZero() && (next.IsZero() || state.next.Before(next)) {
+			next = state.next
+		}
+	}
+
+	return next, !next.IsZero()
+}
+
+// retryDueDomains updates the domains whose retry is due.
+func (a *app) retryDueDomains(ctx context.Context) {
+	domains := a.dueRetries()
+	if len(domains) == 0 {
+		return
+	}
+
+	slog.InfoContext(ctx, "retrying the failed domains", "domains", len(domains))
+	a.updateDomains(ctx, domains)
+}
+
+func (a *app) now() time.Time {
+	if a.clock != nil {
+		return a.clock()
+	}
+
+	return time.Now()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+)
+
+func TestIsPermanent(t *testing.T) {
+	multipleIDs := &mockOVHClient{
+		getFunc: func(url string, resType any) error {
+			jsonInto([]int{1, 2}, resType)
+			return nil
+		},
+	}
+	_, multipleIDsErr := (&ovhBackend{client: multipleIDs}).Find(context.Background(), testDomain(), recordTypeA)
+
+	forbidden := &mockOVHClient{
+		putFunc: func(string, any, any) error {
+			return &ovh.APIError{Code: 403, Message: "This call has not been granted"}
+		},
+	}
+	forbiddenErr := (&ovhBackend{client: forbidden}).Update(context.Background(), testDomain(), record{ID: "1", Type: recordTypeA})
+
+	unavailable := &mockOVHClient{
+		postFunc: func(string, any, any) error {
+			return &ovh.APIError{Code: 503, Message: "Service unavailable"}
+		},
+	}
+	unavailableErr := (&ovhBackend{client: unavailable}).Refresh(context.Background(), "example.com")
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "dns timeout",
+			err:  fmt.Errorf("dns timeout: %w", &net.OpError{Op: "read", Err: context.DeadlineExceeded}),
+		},
+		{
+			name: "ovh server error",
+			err:  unavailableErr,
+		},
+		{
+			name: "ovh forbidden",
+			err:  forbiddenErr,
+			want: true,
+		},
+		{
+			name: "multiple ids",
+			err:  multipleIDsErr,
+			want: true,
+		},
+		{
+			name: "wrapped permanent error",
+			err:  fmt.Errorf("example.com: %w", permanent(fmt.Errorf("invalid credentials"))),
+			want: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if got := isPermanent(tc.err); got != tc.want {
+				t.Fatalf("got permanent %v, want %v: %v", got, tc.want, tc.err)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	a := &app{config: config{RetryInterval: 10 * time.Second}}
+
+	for attempts, want := range map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		3:  40 * time.Second,
+		50: 10 * time.Second << retryMaxShift,
+	} {
+		for range 100 {
+			got := a.backoff(attempts)
+			low := time.Duration(float64(want) * (1 - retryJitter))
+			high := time.Duration(float64(want) * (1 + retryJitter))
+			if got < low || got > high {
+				t.Fatalf("attempt %d: got %s, want between %s and %s", attempts, got, low, high)
+			}
+		}
+	}
+}
+
+func TestUpdateDomainsRetry(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+	d1 := domain{Domain: "example.com", SubDomain: "a"}
+	d2 := domain{Domain: "example.com", SubDomain: "b"}
+
+	now := time.Unix(1700000000, 0)
+	dns := &mockDNSProvider{addr: ip, err: fmt.Errorf("dns timeout")}
+	backend := newMockBackend()
+	a := &app{
+		config: config{
+			Provider:         testProviders,
+			Domains:          []domain{d1, d2},
+			RetryInterval:    time.Minute,
+			RetryMaxAttempts: 3,
+		},
+		backends:    map[string]DNSBackend{defaultBackend: backend},
+		ipProvider:  &mockIPProvider{addr: ip},
+		dnsProvider: dns,
+		clock:       func() time.Time { return now },
+	}
+
+	// Both domains fail with a transient error.
+	a.tryUpdateDomainsIfNeeded(context.Background())
+
+	next, ok := a.nextRetry()
+	if !ok || next.Before(now.Add(48*time.Second)) || next.After(now.Add(72*time.Second)) {
+		t.Fatalf("got next retry %s, %v, want about a minute later", next, ok)
+	}
+	if due := a.dueRetries(); len(due) != 0 {
+		t.Fatalf("expected no retry due yet, got %v", due)
+	}
+
+	// The second attempt also fails.
+	now = now.Add(2 * time.Minute)
+	if due := a.dueRetries(); len(due) != 2 {
+		t.Fatalf("expected 2 retries due, got %v", due)
+	}
+	dns.lookups = nil
+	a.retryDueDomains(context.Background())
+	if len(dns.lookups) != 2 {
+		t.Fatalf("expected 2 lookups, got %v", dns.lookups)
+	}
+
+	next, _ = a.nextRetry()
+	if next.Before(now.Add(96*time.Second)) || next.After(now.Add(144*time.Second)) {
+		t.Fatalf("got next retry %s, want about two minutes later", next)
+	}
+
+	// The third attempt succeeds for the first domain, the second one gives
+	// up after reaching the maximum number of attempts.
+	now = now.Add(3 * time.Minute)
+	dns.err = nil
+	backend.err = fmt.Errorf("api unavailable")
+	dns.addr = netip.Addr{}
+	a.config.Domains[0].Provider = "missing"
+	a.retryDueDomains(context.Background())
+
+	if _, ok := a.nextRetry(); ok {
+		t.Fatal("expected no retry scheduled")
+	}
+	if state := a.retries[d2.hostname()]; state == nil || state.attempts != 3 {
+		t.Fatalf("got retry state %+v, want 3 attempts", state)
+	}
+
+	// A new check clears the state of the domains that succeed.
+	backend.err = nil
+	a.config.Domains[0].Provider = ""
+	a.tryUpdateDomainsIfNeeded(context.Background())
+	if len(a.retries) != 0 {
+		t.Fatalf("expected no retry state, got %v", a.retries)
+	}
+}
+
+func TestUpdateDomainsPermanentError(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+	d := domain{Domain: "example.com", SubDomain: "a"}
+
+	backend := newMockBackend()
+	backend.err = permanent(fmt.Errorf("forbidden"))
+	a := &app{
+		config:      config{Provider: testProviders, Domains: []domain{d}},
+		backends:    map[string]DNSBackend{defaultBackend: backend},
+		ipProvider:  &mockIPProvider{addr: ip},
+		dnsProvider: &mockDNSProvider{},
+	}
+
+	a.tryUpdateDomainsIfNeeded(context.Background())
+
+	if _, ok := a.nextRetry(); ok {
+		t.Fatal("expected no retry scheduled for a permanent error")
+	}
+	if state := a.retries[d.hostname()]; state == nil || !isPermanent(state.err) {
+		t.Fatalf("got retry state %+v, want a permanent error", state)
+	}
+}
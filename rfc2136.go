@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// RFC 2136 constants.
+const (
+	dnsOpCodeUpdate = dnsmessage.OpCode(5)
+	dnsClassNone    = dnsmessage.Class(254)
+	dnsRCodeNotAuth = dnsmessage.RCode(9)
+)
+
+// rfc2136RCodes names the response codes specific to dynamic updates.
+var rfc2136RCodes = map[dnsmessage.RCode]string{
+	6:  "YXDOMAIN: name exists when it should not",
+	7:  "YXRRSET: record exists when it should not",
+	8:  "NXRRSET: record does not exist or has changed",
+	9:  "NOTAUTH: server not authoritative for the zone or request not authorized",
+	10: "NOTZONE: name not within the zone",
+}
+
+type rfc2136Config struct {
+	// Server is the primary nameserver accepting the updates, using the
+	// same format as dns_provider.
+	Server string `yaml:"server"`
+	TSIG   struct {
+		Name      string `yaml:"name"`
+		Algorithm string `yaml:"algorithm"`
+		Secret    string `yaml:"secret"`
+	} `yaml:"tsig"`
+}
+
+// rfc2136Backend manages the records by sending RFC 2136 dynamic updates
+// signed with TSIG to the primary nameserver of the zone. The ID of a record
+// is its current target, used as a prerequisite to replace it.
+type rfc2136Backend struct {
+	transport dnsTransport
+	key       *tsigKey
+	now       func() time.Time
+}
+
+func newRFC2136Backend(cfg rfc2136Config) (*rfc2136Backend, error) {
+	if cfg.Server == "" {
+		return nil, fmt.Errorf("missing server")
+	}
+
+	transport, err := newDNSTransport(cfg.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := newTSIGKey(cfg.TSIG.Name, cfg.TSIG.Algorithm, cfg.TSIG.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rfc2136Backend{
+		transport: transport,
+		key:       key,
+		now:       time.Now,
+	}, nil
+}
+
+func (b *rfc2136Backend) Find(ctx context.Context, d domain, t recordType) (*record, error) {
+	name, err := fqdn(d.hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := dnsQuery(ctx, b.transport, name, t.dnsType(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []record
+	for _, answer := range resp.Answers {
+		if a, ok := resourceAddr(answer.Body); ok && t.match(a) && answer.Header.Name == name {
+			records = append(records, record{
+				ID:     a.String(),
+				Type:   t,
+				Target: a.String(),
+				TTL:    time.Duration(answer.Header.TTL) * time.Second,
+			})
+		}
+	}
+
+	switch {
+	case resp.RCode != dnsmessage.RCodeSuccess && resp.RCode != dnsmessage.RCodeNameError:
+		return nil, fmt.Errorf("dns error: %s", resp.RCode)
+	case len(records) == 0:
+		return nil, nil
+	case len(records) == 1:
+		return &records[0], nil
+	default:
+		return nil, permanent(fmt.Errorf("multiple %s records for this name, something's wrong", t))
+	}
+}
+
+// Create adds the record, provided there is no record of this type yet.
+func (b *rfc2136Backend) Create(ctx context.Context, d domain, r record) error {
+	prereq, err := b.rrset(d, r.Type, dnsClassNone, 0, "")
+	if err != nil {
+		return err
+	}
+
+	add, err := b.rrset(d, r.Type, dnsmessage.ClassINET, r.TTL, r.Target)
+	if err != nil {
+		return err
+	}
+
+	if err := b.update(ctx, d, []dnsmessage.Resource{prereq}, []dnsmessage.Resource{add}); err != nil {
+		return fmt.Errorf("failed to create the zone record: %w", err)
+	}
+
+	return nil
+}
+
+// Update replaces the record set of the given type, provided it still holds
+// the record identified by the ID only.
+func (b *rfc2136Backend) Update(ctx context.Context, d domain, r record) error {
+	prereq, err := b.rrset(d, r.Type, dnsmessage.ClassINET, 0, r.ID)
+	if err != nil {
+		return err
+	}
+
+	del, err := b.rrset(d, r.Type, dnsmessage.ClassANY, 0, "")
+	if err != nil {
+		return err
+	}
+
+	add, err := b.rrset(d, r.Type, dnsmessage.ClassINET, r.TTL, r.Target)
+	if err != nil {
+		return err
+	}
+
+	if err := b.update(ctx, d, []dnsmessage.Resource{prereq}, []dnsmessage.Resource{del, add}); err != nil {
+		return fmt.Errorf("failed to update the zone record: %w", err)
+	}
+
+	return nil
+}
+
+// Delete removes the record set of the given type.
+func (b *rfc2136Backend) Delete(ctx context.Context, d domain, r record) error {
+	del, err := b.rrset(d, r.Type, dnsmessage.ClassANY, 0, "")
+	if err != nil {
+		return err
+	}
+
+	if err := b.update(ctx, d, nil, []dnsmessage.Resource{del}); err != nil {
+		return fmt.Errorf("failed to delete the zone record: %w", err)
+	}
+
+	return nil
+}
+
+// Refresh does nothing, the server increments the zone serial on each update.
+func (b *rfc2136Backend) Refresh(context.Context, string) error {
+	return nil
+}
+
+// rrset builds a record of the domain, with an empty value if target is
+// empty, as used by the prerequisite and update sections.
+func (b *rfc2136Backend) rrset(d domain, t recordType, class dnsmessage.Class, ttl time.Duration, target string) (dnsmessage.Resource, error) {
+	name, err := fqdn(d.hostname())
+	if err != nil {
+		return dnsmessage.Resource{}, err
+	}
+
+	var body dnsmessage.ResourceBody = &dnsmessage.UnknownResource{Type: t.dnsType()}
+	if target != "" {
+		addr, err := netip.ParseAddr(target)
+		if err != nil {
+			return dnsmessage.Resource{}, err
+		}
+
+		if !t.match(addr) {
+			return dnsmessage.Resource{}, fmt.Errorf("invalid %s target %s", t, addr)
+		}
+
+		if t == recordTypeA {
+			body = &dnsmessage.AResource{A: addr.As4()}
+		} else {
+			body = &dnsmessage.AAAAResource{AAAA: addr.As16()}
+		}
+	}
+
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  name,
+			Type:  t.dnsType(),
+			Class: class,
+			TTL:   uint32(ttl.Seconds()),
+		},
+		Body: body,
+	}, nil
+}
+
+// update sends a signed update message for the zone of the domain.
+func (b *rfc2136Backend) update(ctx context.Context, d domain, prereqs, updates []dnsmessage.Resource) error {
+	zone, err := fqdn(d.Domain)
+	if err != nil {
+		return err
+	}
+
+	id, err := newDNSID()
+	if err != nil {
+		return err
+	}
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, OpCode: dnsOpCodeUpdate},
+		Questions: []dnsmessage.Question{{
+			Name:  zone,
+			Type:  dnsmessage.TypeSOA,
+			Class: dnsmessage.ClassINET,
+		}},
+		Answers:     prereqs,
+		Authorities: updates,
+	}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	signed, mac := b.key.sign(packed, nil, b.now())
+	raw, err := b.transport.Exchange(ctx, signed)
+	if err != nil {
+		return err
+	}
+
+	var p dnsmessage.Parser
+	header, err := p.Start(raw)
+	if err != nil {
+		return fmt.Errorf("invalid dns response: %w", err)
+	}
+
+	if header.ID != id || !header.Response {
+		return fmt.Errorf("dns response does not match the update")
+	}
+
+	// Servers rejecting the request may not sign their response, the error
+	// code is then reported instead of the missing signature.
+	_, verifyErr := b.key.verify(raw, mac, b.now())
+	if errors.Is(verifyErr, errTSIGMissing) && header.RCode != dnsmessage.RCodeSuccess {
+		verifyErr = nil
+	}
+	if verifyErr != nil {
+		return permanent(verifyErr)
+	}
+
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+		return nil
+	case dnsmessage.RCodeRefused, dnsRCodeNotAuth:
+		// The server will keep refusing the key.
+		return permanent(fmt.Errorf("update refused: %s", rfc2136RCodeString(header.RCode)))
+	default:
+		return fmt.Errorf("update refused: %s", rfc2136RCodeString(header.RCode))
+	}
+}
+
+// rfc2136RCodeString describes the response code of an update.
+func rfc2136RCodeString(rcode dnsmessage.RCode) string {
+	if msg, ok := rfc2136RCodes[rcode]; ok {
+		return msg
+	}
+
+	return rcode.String()
+}
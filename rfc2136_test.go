@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testUpdateServer is a nameserver of the example.com zone applying the
+// signed dynamic updates it receives.
+type testUpdateServer struct {
+	t   *testing.T
+	key *tsigKey
+	now time.Time
+
+	mu      sync.Mutex
+	records map[dnsmessage.Type][]netip.Addr // Records of home.example.com
+	updates int
+}
+
+func (s *testUpdateServer) handle(raw []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var p dnsmessage.Parser
+	header, err := p.Start(raw)
+	if err != nil {
+		return nil
+	}
+
+	question, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:            header.ID,
+			Response:      true,
+			OpCode:        header.OpCode,
+			Authoritative: true,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+
+	if header.OpCode != dnsOpCodeUpdate {
+		for _, addr := range s.records[question.Type] {
+			var body dnsmessage.ResourceBody = &dnsmessage.AResource{A: addr.As4()}
+			if question.Type == dnsmessage.TypeAAAA {
+				body = &dnsmessage.AAAAResource{AAAA: addr.As16()}
+			}
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: question.Class, TTL: 60},
+				Body:   body,
+			})
+		}
+
+		packed, _ := resp.Pack()
+		return packed
+	}
+
+	reqMAC, err := s.key.verify(raw, nil, s.now)
+	if err != nil {
+		resp.RCode = dnsmessage.RCode(9) // NOTAUTH
+		packed, _ := resp.Pack()
+		return packed
+	}
+
+	resp.RCode = s.apply(&p)
+	packed, err := resp.Pack()
+	if err != nil {
+		s.t.Error(err)
+		return nil
+	}
+
+	signed, _ := s.key.sign(packed, reqMAC, s.now)
+	return signed
+}
+
+// apply checks the prerequisites of the update then applies it.
+func (s *testUpdateServer) apply(p *dnsmessage.Parser) dnsmessage.RCode {
+	if err := p.SkipAllQuestions(); err != nil {
+		return dnsmessage.RCodeFormatError
+	}
+
+	for {
+		h, addr, err := testUpdateResource(p, p.AnswerHeader, p.SkipAnswer)
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return dnsmessage.RCodeFormatError
+		}
+
+		records := s.records[h.Type]
+		switch h.Class {
+		case dnsClassNone:
+			if len(records) > 0 {
+				return dnsmessage.RCode(7) // YXRRSET
+			}
+		case dnsmessage.ClassINET:
+			if !slices.Equal(records, []netip.Addr{addr}) {
+				return dnsmessage.RCode(8) // NXRRSET
+			}
+		default:
+			return dnsmessage.RCodeFormatError
+		}
+	}
+
+	for {
+		h, addr, err := testUpdateResource(p, p.AuthorityHeader, p.SkipAuthority)
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return dnsmessage.RCodeFormatError
+		}
+
+		switch h.Class {
+		case dnsmessage.ClassANY:
+			delete(s.records, h.Type)
+		case dnsmessage.ClassINET:
+			s.records[h.Type] = append(s.records[h.Type], addr)
+		default:
+			return dnsmessage.RCodeFormatError
+		}
+	}
+
+	s.updates++
+	return dnsmessage.RCodeSuccess
+}
+
+// testUpdateResource reads the next resource of a section, along with its
+// address if it has one.
+func testUpdateResource(
+	p *dnsmessage.Parser,
+	header func() (dnsmessage.ResourceHeader, error),
+	skip func() error,
+) (dnsmessage.ResourceHeader, netip.Addr, error) {
+	h, err := header()
+	if err != nil {
+		return h, netip.Addr{}, err
+	}
+
+	if h.Class != dnsmessage.ClassINET || h.Length == 0 {
+		return h, netip.Addr{}, skip()
+	}
+
+	switch h.Type {
+	case dnsmessage.TypeA:
+		r, err := p.AResource()
+		return h, netip.AddrFrom4(r.A), err
+	case dnsmessage.TypeAAAA:
+		r, err := p.AAAAResource()
+		return h, netip.AddrFrom16(r.AAAA), err
+	default:
+		return h, netip.Addr{}, skip()
+	}
+}
+
+func TestRFC2136Backend(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ip := netip.MustParseAddr("203.0.113.1")
+	oldIP := netip.MustParseAddr("198.51.100.1")
+	d := domain{Domain: "example.com", SubDomain: "home", TTL: time.Minute}
+	publish := func(b *rfc2136Backend) error {
+		return updateRecord(&app{backends: map[string]DNSBackend{defaultBackend: b}}, d, ip)
+	}
+
+	tests := []struct {
+		name        string
+		records     map[dnsmessage.Type][]netip.Addr
+		tcp         bool
+		secret      string
+		update      func(b *rfc2136Backend) error
+		wantRecords map[dnsmessage.Type][]netip.Addr
+		wantErr     bool
+	}{
+		{
+			name:        "create",
+			records:     map[dnsmessage.Type][]netip.Addr{},
+			update:      publish,
+			wantRecords: map[dnsmessage.Type][]netip.Addr{dnsmessage.TypeA: {ip}},
+		},
+		{
+			name:        "update",
+			records:     map[dnsmessage.Type][]netip.Addr{dnsmessage.TypeA: {oldIP}},
+			update:      publish,
+			wantRecords: map[dnsmessage.Type][]netip.Addr{dnsmessage.TypeA: {ip}},
+		},
+		{
+			name:        "update over tcp",
+			records:     map[dnsmessage.Type][]netip.Addr{dnsmessage.TypeA: {oldIP}},
+			tcp:         true,
+			update:      publish,
+			wantRecords: map[dnsmessage.Type][]netip.Addr{dnsmessage.TypeA: {ip}},
+		},
+		{
+			name:    "create an existing record",
+			records: map[dnsmessage.Type][]netip.Addr{dnsmessage.TypeA: {oldIP}},
+			update: func(b *rfc2136Backend) error {
+				return b.Create(context.Background(), d, newRecord(d, ip))
+			},
+			wantRecords: map[dnsmessage.Type][]netip.Addr{dnsmessage.TypeA: {oldIP}},
+			wantErr:     true,
+		},
+		{
+			name:    "update a changed record",
+			records: map[dnsmessage.Type][]netip.Addr{dnsmessage.TypeA: {oldIP}},
+			update: func(b *rfc2136Backend) error {
+				r := newRecord(d, ip)
+				r.ID = "192.0.2.1"
+				return b.Update(context.Background(), d, r)
+			},
+			wantRecords: map[dnsmessage.Type][]netip.Addr{dnsmessage.TypeA: {oldIP}},
+			wantErr:     true,
+		},
+		{
+			name:    "delete",
+			records: map[dnsmessage.Type][]netip.Addr{dnsmessage.TypeA: {oldIP}},
+			update: func(b *rfc2136Backend) error {
+				return b.Delete(context.Background(), d, record{Type: recordTypeA})
+			},
+			wantRecords: map[dnsmessage.Type][]netip.Addr{},
+		},
+		{
+			name:        "invalid key",
+			records:     map[dnsmessage.Type][]netip.Addr{dnsmessage.TypeA: {oldIP}},
+			secret:      "b3RoZXItc2VjcmV0",
+			update:      publish,
+			wantRecords: map[dnsmessage.Type][]netip.Addr{dnsmessage.TypeA: {oldIP}},
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server := &testUpdateServer{
+				t:       t,
+				key:     testTSIGKey(t, testTSIGSecret),
+				now:     now,
+				records: tc.records,
+			}
+
+			var transport dnsTransport
+			if tc.tcp {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				transport = &streamTransport{server: testDNSStreamServer(t, ln, server.handle)}
+			} else {
+				transport = &udpTransport{server: testDNSPacketServer(t, server.handle)}
+			}
+
+			secret := tc.secret
+			if secret == "" {
+				secret = testTSIGSecret
+			}
+
+			b := &rfc2136Backend{
+				transport: transport,
+				key:       testTSIGKey(t, secret),
+				now:       func() time.Time { return now },
+			}
+
+			err := tc.update(b)
+
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if len(server.records) != len(tc.wantRecords) {
+				t.Fatalf("got records %v, want %v", server.records, tc.wantRecords)
+			}
+			for typ, want := range tc.wantRecords {
+				if !slices.Equal(server.records[typ], want) {
+					t.Fatalf("got records %v, want %v", server.records, tc.wantRecords)
+				}
+			}
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRFC2136BackendUnsignedResponse(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	d := domain{Domain: "example.com", SubDomain: "home", TTL: time.Minute}
+
+	// A server accepting the update without signing its response cannot be
+	// trusted.
+	addr := testDNSPacketServer(t, func(raw []byte) []byte {
+		resp := append([]byte(nil), raw[:4]...)
+		resp[2] |= 0x80 // QR
+		return append(resp, make([]byte, dnsHeaderSize-4)...)
+	})
+
+	b := &rfc2136Backend{
+		transport: &udpTransport{server: addr},
+		key:       testTSIGKey(t, testTSIGSecret),
+		now:       func() time.Time { return now },
+	}
+
+	err := b.Create(context.Background(), d, newRecord(d, netip.MustParseAddr("203.0.113.1")))
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
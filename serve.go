@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultServeListen is the traditional port of the dyndns2 protocol.
+const defaultServeListen = ":8245"
+
+type serveConfig struct {
+	Listen string `yaml:"listen"`
+	// Hostnames holds the credentials allowed to update each hostname.
+	Hostnames map[string]serveCredentials `yaml:"hostnames"`
+}
+
+type serveCredentials struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func (c serveConfig) listen() string {
+	if c.Listen == "" {
+		return defaultServeListen
+	}
+
+	return c.Listen
+}
+
+// validate ensures every hostname with credentials is a configured domain.
+func (c serveConfig) validate(domains []domain) error {
+	for hostname, creds := range c.Hostnames {
+		if !slices.ContainsFunc(domains, func(d domain) bool { return d.hostname() == hostname }) {
+			return fmt.Errorf("serve: %s is not a configured domain", hostname)
+		}
+
+		if creds.Username == "" || creds.Password == "" {
+			return fmt.Errorf("serve: %s: missing username or password", hostname)
+		}
+	}
+
+	return nil
+}
+
+// dyndns2Server implements the update endpoint of the dyndns2 protocol, the
+// addresses pushed by the clients are published using the backend of each
+// domain.
+type dyndns2Server struct {
+	app *app
+
+	// mu serializes the update requests.
+	mu sync.Mutex
+	// last holds the last address published, keyed by hostname and type.
+	last map[string]netip.Addr
+}
+
+func newDynDNS2Server(a *app) *dyndns2Server {
+	return &dyndns2Server{
+		app:  a,
+		last: map[string]netip.Addr{},
+	}
+}
+
+func (a *app) serve() error {
+	if len(a.config.Serve.Hostnames) == 0 {
+		return fmt.Errorf("serve: no hostnames configured")
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	if err := a.startMetrics(ctx); err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/nic/update", newDynDNS2Server(a))
+	srv := &http.Server{
+		Addr:              a.config.Serve.listen(),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	// The configuration is only reloaded in daemon mode, SIGHUP must not
+	// stop the server.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	slog.Info("serving dyndns2 updates", "addr", srv.Addr)
+
+	for ctx.Err() == nil {
+		select {
+		case err := <-errs:
+			return err
+		case <-hup:
+			slog.Warn("the configuration is not reloaded in serve mode, restart to apply it")
+		case <-ctx.Done():
+		}
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	err := srv.Shutdown(shutdownCtx)
+	a.waitBackground(backgroundShutdownTimeout)
+	return err
+}
+
+func (s *dyndns2Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="waybackd"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, "badauth")
+		return
+	}
+
+	q := r.URL.Query()
+	addrs, err := dyndns2Addrs(q.Get("myip"), q.Get("myipv6"), r.RemoteAddr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "badip")
+		return
+	}
+
+	// The changes of every hostname are applied together, to refresh each
+	// zone once.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var hosts []*dyndns2Host
+	var changes []recordChange
+	for _, hostname := range strings.Split(q.Get("hostname"), ",") {
+		host := s.host(strings.TrimSpace(hostname), username, password)
+		hosts = append(hosts, host)
+		if host.code != "" {
+			continue
+		}
+
+		for _, addr := range addrs {
+			t := recordTypeOf(addr)
+			if !slices.Contains(host.domain.recordTypes(), t) {
+				continue
+			}
+
+			host.published = append(host.published, addr.String())
+			if s.last[host.key(t)] == addr {
+				continue
+			}
+
+			slog.InfoContext(r.Context(), "dyndns2 update", "hostname", host.domain.hostname(), "new_ip", addr)
+			host.changes = append(host.changes, len(changes))
+			changes = append(changes, recordChange{domain: host.domain, ip: addr})
+		}
+	}
+
+	errs := s.app.updateZones(r.Context(), changes)
+	s.app.saveState(r.Context())
+
+	var lines []string
+	for _, host := range hosts {
+		lines = append(lines, s.response(host, changes, errs))
+	}
+
+	fmt.Fprintln(w, strings.Join(lines, "\n"))
+}
+
+// dyndns2Host is a hostname of an update request.
+type dyndns2Host struct {
+	domain domain
+	// code is the response code of the hostname when it is rejected.
+	code string
+	// published lists the addresses to publish.
+	published []string
+	// changes holds the indexes of its record changes.
+	changes []int
+}
+
+func (h *dyndns2Host) key(t recordType) string {
+	return h.domain.hostname() + "/" + string(t)
+}
+
+// host returns the hostname of the request, rejected if the credentials do
+// not allow its update.
+func (s *dyndns2Server) host(hostname, username, password string) *dyndns2Host {
+	if hostname == "" {
+		return &dyndns2Host{code: "notfqdn"}
+	}
+
+	creds, ok := s.app.config.Serve.Hostnames[hostname]
+	if !ok {
+		return &dyndns2Host{code: "nohost"}
+	}
+
+	if subtle.ConstantTimeCompare([]byte(username), []byte(creds.Username)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(creds.Password)) != 1 {
+		slog.Warn("dyndns2 update refused: invalid credentials", "hostname", hostname)
+		return &dyndns2Host{code: "badauth"}
+	}
+
+	i := slices.IndexFunc(s.app.config.Domains, func(d domain) bool { return d.hostname() == hostname })
+	if i < 0 {
+		return &dyndns2Host{code: "nohost"}
+	}
+
+	return &dyndns2Host{domain: s.app.config.Domains[i]}
+}
+
+// response returns the response line of the hostname once its changes are
+// applied, and remembers the addresses published.
+func (s *dyndns2Server) response(host *dyndns2Host, changes []recordChange, errs []error) string {
+	if host.code != "" {
+		return host.code
+	}
+
+	for _, i := range host.changes {
+		if err := errs[i]; err != nil {
+			slog.Error("failed to update the record", "hostname", host.domain.hostname(),
+				"zone", host.domain.Domain, "type", recordTypeOf(changes[i].ip), "new_ip", changes[i].ip, "error", err)
+			return "911"
+		}
+	}
+
+	for _, i := range host.changes {
+		s.last[host.key(recordTypeOf(changes[i].ip))] = changes[i].ip
+	}
+
+	if len(host.published) == 0 {
+		return "nochg"
+	}
+
+	code := "nochg"
+	if len(host.changes) > 0 {
+		code = "good"
+	}
+
+	return code + " " + strings.Join(host.published, ",")
+}
+
+// dyndns2Addrs returns the addresses of the myip and myipv6 parameters, both
+// possibly holding a comma separated list. The address of the client is used
+// if none is given.
+func dyndns2Addrs(myip, myipv6, remoteAddr string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	for _, param := range []string{myip, myipv6} {
+		for _, s := range strings.Split(param, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil, errors.New("invalid client address")
+	}
+
+	return []netip.Addr{addr.Unmap()}, nil
+}
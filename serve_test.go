@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDynDNS2Server(t *testing.T) {
+	home := domain{Domain: "example.com", SubDomain: "home", RecordTypes: []recordType{recordTypeA, recordTypeAAAA}}
+	nas := domain{Domain: "example.com", SubDomain: "nas"}
+	other := domain{Domain: "example.com", SubDomain: "other"}
+
+	type request struct {
+		query    string
+		username string
+		password string
+		noAuth   bool
+	}
+
+	tests := []struct {
+		name        string
+		requests    []request
+		backendErr  error
+		wantStatus  int
+		wantBody    string
+		wantRecords map[string]string
+	}{
+		{
+			name:        "good",
+			requests:    []request{{query: "hostname=home.example.com&myip=203.0.113.1"}},
+			wantStatus:  http.StatusOK,
+			wantBody:    "good 203.0.113.1",
+			wantRecords: map[string]string{"home.example.com/A": "203.0.113.1"},
+		},
+		{
+			name: "nochg",
+			requests: []request{
+				{query: "hostname=home.example.com&myip=203.0.113.1"},
+				{query: "hostname=home.example.com&myip=203.0.113.1"},
+			},
+			wantStatus:  http.StatusOK,
+			wantBody:    "nochg 203.0.113.1",
+			wantRecords: map[string]string{"home.example.com/A": "203.0.113.1"},
+		},
+		{
+			name:       "IPv4 and IPv6",
+			requests:   []request{{query: "hostname=home.example.com&myip=203.0.113.1&myipv6=2001:db8::1"}},
+			wantStatus: http.StatusOK,
+			wantBody:   "good 203.0.113.1,2001:db8::1",
+			wantRecords: map[string]string{
+				"home.example.com/A":    "203.0.113.1",
+				"home.example.com/AAAA": "2001:db8::1",
+			},
+		},
+		{
+			name:        "ignored record type",
+			requests:    []request{{query: "hostname=nas.example.com&myip=203.0.113.1,2001:db8::1", username: "nas"}},
+			wantStatus:  http.StatusOK,
+			wantBody:    "good 203.0.113.1",
+			wantRecords: map[string]string{"nas.example.com/A": "203.0.113.1"},
+		},
+		{
+			name:        "client address",
+			requests:    []request{{query: "hostname=home.example.com"}},
+			wantStatus:  http.StatusOK,
+			wantBody:    "good 192.0.2.1",
+			wantRecords: map[string]string{"home.example.com/A": "192.0.2.1"},
+		},
+		{
+			name:        "multiple hostnames",
+			requests:    []request{{query: "hostname=home.example.com,missing.example.com&myip=203.0.113.1"}},
+			wantStatus:  http.StatusOK,
+			wantBody:    "good 203.0.113.1\nnohost",
+			wantRecords: map[string]string{"home.example.com/A": "203.0.113.1"},
+		},
+		{
+			name:       "missing credentials",
+			requests:   []request{{query: "hostname=home.example.com&myip=203.0.113.1", noAuth: true}},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "badauth",
+		},
+		{
+			name:       "invalid password",
+			requests:   []request{{query: "hostname=home.example.com&myip=203.0.113.1", password: "wrong"}},
+			wantStatus: http.StatusOK,
+			wantBody:   "badauth",
+		},
+		{
+			name:       "credentials of another hostname",
+			requests:   []request{{query: "hostname=nas.example.com&myip=203.0.113.1"}},
+			wantStatus: http.StatusOK,
+			wantBody:   "badauth",
+		},
+		{
+			name:       "hostname without credentials",
+			requests:   []request{{query: "hostname=other.example.com&myip=203.0.113.1"}},
+			wantStatus: http.StatusOK,
+			wantBody:   "nohost",
+		},
+		{
+			name:       "missing hostname",
+			requests:   []request{{query: "myip=203.0.113.1"}},
+			wantStatus: http.StatusOK,
+			wantBody:   "notfqdn",
+		},
+		{
+			name:       "invalid address",
+			requests:   []request{{query: "hostname=home.example.com&myip=not-an-ip"}},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "badip",
+		},
+		{
+			name:       "backend error",
+			requests:   []request{{query: "hostname=home.example.com&myip=203.0.113.1"}},
+			backendErr: fmt.Errorf("api unavailable"),
+			wantStatus: http.StatusOK,
+			wantBody:   "911",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newMockBackend()
+			backend.err = tc.backendErr
+			a := &app{
+				config: config{
+					Domains: []domain{home, nas, other},
+					Serve: serveConfig{Hostnames: map[string]serveCredentials{
+						"home.example.com": {Username: "home", Password: "secret"},
+						"nas.example.com":  {Username: "nas", Password: "secret"},
+					}},
+				},
+				backends: map[string]DNSBackend{defaultBackend: backend},
+			}
+			server := newDynDNS2Server(a)
+
+			var rec *httptest.ResponseRecorder
+			for _, r := range tc.requests {
+				req := httptest.NewRequest("GET", "/nic/update?"+r.query, nil)
+				req.RemoteAddr = "192.0.2.1:1234"
+				if !r.noAuth {
+					username, password := r.username, r.password
+					if username == "" {
+						username = "home"
+					}
+					if password == "" {
+						password = "secret"
+					}
+					req.SetBasicAuth(username, password)
+				}
+
+				rec = httptest.NewRecorder()
+				server.ServeHTTP(rec, req)
+			}
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("got status %d, want %d", rec.Code, tc.wantStatus)
+			}
+
+			if body := strings.TrimSpace(rec.Body.String()); body != tc.wantBody {
+				t.Fatalf("got body %q, want %q", body, tc.wantBody)
+			}
+
+			if len(backend.records) != len(tc.wantRecords) {
+				t.Fatalf("got records %v, want %v", backend.records, tc.wantRecords)
+			}
+			for key, target := range tc.wantRecords {
+				if backend.records[key].Target != target {
+					t.Fatalf("got records %v, want %v", backend.records, tc.wantRecords)
+				}
+			}
+
+			if len(backend.creates) != len(tc.wantRecords) {
+				t.Fatalf("got %d creates, want %d", len(backend.creates), len(tc.wantRecords))
+			}
+		})
+	}
+}
+
+func TestServeConfigValidate(t *testing.T) {
+	domains := []domain{{Domain: "example.com", SubDomain: "home"}}
+
+	tests := []struct {
+		name    string
+		config  serveConfig
+		wantErr bool
+	}{
+		{
+			name:   "no hostnames",
+			config: serveConfig{},
+		},
+		{
+			name: "valid hostname",
+			config: serveConfig{Hostnames: map[string]serveCredentials{
+				"home.example.com": {Username: "home", Password: "secret"},
+			}},
+		},
+		{
+			name: "unknown hostname",
+			config: serveConfig{Hostnames: map[string]serveCredentials{
+				"nas.example.com": {Username: "nas", Password: "secret"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "missing password",
+			config: serveConfig{Hostnames: map[string]serveCredentials{
+				"home.example.com": {Username: "home"},
+			}},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.validate(domains)
+
+			if tc.wantErr && err == nil {
+				t.Fatal("expected error, got nil")
+			}
+
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// publishedRecord is the last address published for a record type of a
+// hostname.
+type publishedRecord struct {
+	IP netip.Addr `json:"ip"`
+	// ID identifies the record in the backend, empty if unknown.
+	ID        string    `json:"id,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// hostnameState is what is known about a hostname across restarts.
+type hostnameState struct {
+	Records     map[recordType]publishedRecord `json:"records,omitempty"`
+	LastError   string                         `json:"last_error,omitempty"`
+	LastErrorAt time.Time                      `json:"last_error_at,omitzero"`
+}
+
+// stateFile persists the state of the hostnames as JSON. A nil stateFile
+// keeps nothing.
+type stateFile struct {
+	path string
+
+	mu        sync.Mutex
+	Hostnames map[string]*hostnameState `json:"hostnames"`
+}
+
+// loadState reads the state file at the given path, a missing file holding
+// an empty state.
+func loadState(path string) (*stateFile, error) {
+	s := &stateFile{path: path, Hostnames: map[string]*hostnameState{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to decode the state file %s: %w", path, err)
+	}
+
+	if s.Hostnames == nil {
+		s.Hostnames = map[string]*hostnameState{}
+	}
+
+	return s, nil
+}
+
+func (s *stateFile) hostname(hostname string) *hostnameState {
+	h, ok := s.Hostnames[hostname]
+	if !ok {
+		h = &hostnameState{}
+		s.Hostnames[hostname] = h
+	}
+
+	return h
+}
+
+// published returns the last address published for the record type of the
+// hostname.
+func (s *stateFile) published(hostname string, t recordType) (publishedRecord, bool) {
+	if s == nil {
+		return publishedRecord{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.Hostnames[hostname]
+	if !ok {
+		return publishedRecord{}, false
+	}
+
+	r, ok := h.Records[t]
+	return r, ok
+}
+
+// setPublished records the address published for the hostname. The update
+// time is kept if the address did not change, and the ID if the new one is
+// unknown.
+func (s *stateFile) setPublished(hostname string, t recordType, r publishedRecord) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.hostname(hostname)
+	if h.Records == nil {
+		h.Records = map[recordType]publishedRecord{}
+	}
+
+	if old, ok := h.Records[t]; ok {
+		if old.IP == r.IP && !old.UpdatedAt.IsZero() {
+			r.UpdatedAt = old.UpdatedAt
+		}
+		if r.ID == "" {
+			r.ID = old.ID
+		}
+	}
+	h.Records[t] = r
+}
+
+// forget removes the record type of the hostname, e.g. after an update
+// failed with a possibly stale ID.
+func (s *stateFile) forget(hostname string, t recordType) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if h, ok := s.Hostnames[hostname]; ok {
+		delete(h.Records, t)
+	}
+}
+
+// setError records the result of the last attempt for the hostname, a nil
+// error clearing the previous one.
+func (s *stateFile) setError(hostname string, err error, at time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.hostname(hostname)
+	if err == nil {
+		h.LastError = ""
+		h.LastErrorAt = time.Time{}
+		return
+	}
+
+	h.LastError = err.Error()
+	h.LastErrorAt = at
+}
+
+// save writes the state atomically, using a temporary file renamed over the
+// previous one.
+func (s *stateFile) save() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// saveState writes the state file, if any.
+func (a *app) saveState(ctx context.Context) {
+	if err := a.state.save(); err != nil {
+		slog.ErrorContext(ctx, "failed to save the state", "error", err)
+	}
+}
+
+// stateChange completes the change with the record ID stored in the state,
+// sparing the backend a lookup. The ID is only used by the backends keeping
+// it across updates.
+func (a *app) stateChange(c recordChange) recordChange {
+	backend, err := a.backend(c.domain)
+	if err != nil {
+		return c
+	}
+
+	if _, ok := backend.(StableIDBackend); !ok {
+		return c
+	}
+
+	// The address was already published, the record was changed behind our
+	// back and is looked up again.
+	t := recordTypeOf(c.ip)
+	p, ok := a.state.published(c.domain.hostname(), t)
+	if !ok || p.ID == "" || p.IP == c.ip {
+		return c
+	}
+
+	switch {
+	case !c.known:
+		c.known = true
+		c.current = &record{ID: p.ID, Type: t, Target: p.IP.String(), TTL: c.domain.TTL}
+	case c.current != nil && c.current.ID == "":
+		current := *c.current
+		current.ID = p.ID
+		c.current = &current
+	}
+
+	return c
+}
+
+// recentlyPublished returns true if the address of the domain was published
+// less than its TTL ago.
+func (a *app) recentlyPublished(d domain, ip netip.Addr) bool {
+	p, ok := a.state.published(d.hostname(), recordTypeOf(ip))
+	return ok && p.IP == ip && a.now().Sub(p.UpdatedAt) < d.TTL
+}
+
+// statePublished records the result of the change in the state. The record
+// of a failed change is forgotten, its ID may be stale, and the one of a
+// changed record gets a new update time.
+func (a *app) statePublished(c recordChange, r *record, changed bool, err error) {
+	hostname, t := c.domain.hostname(), recordTypeOf(c.ip)
+	if err != nil || changed {
+		a.state.forget(hostname, t)
+	}
+	if err != nil {
+		return
+	}
+
+	p := publishedRecord{IP: c.ip, UpdatedAt: a.now()}
+	if backend, _ := a.backend(c.domain); r != nil {
+		if _, ok := backend.(StableIDBackend); ok {
+			p.ID = r.ID
+		}
+	}
+	a.state.setPublished(hostname, t, p)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	ip := netip.MustParseAddr("203.0.113.1")
+	newIP := netip.MustParseAddr("203.0.113.2")
+	t1 := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	s, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.published("home.example.com", recordTypeA); ok {
+		t.Fatal("expected an empty state")
+	}
+
+	s.setPublished("home.example.com", recordTypeA, publishedRecord{IP: ip, ID: "42", UpdatedAt: t1})
+	// The same address keeps its update time and ID.
+	s.setPublished("home.example.com", recordTypeA, publishedRecord{IP: ip, UpdatedAt: t2})
+	s.setError("home.example.com", fmt.Errorf("api unavailable"), t2)
+	s.setPublished("other.example.com", recordTypeAAAA, publishedRecord{IP: netip.MustParseAddr("2001:db8::1"), UpdatedAt: t1})
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected the state file only, got %v", entries)
+	}
+
+	s, err = loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := publishedRecord{IP: ip, ID: "42", UpdatedAt: t1}
+	if got, _ := s.published("home.example.com", recordTypeA); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if h := s.Hostnames["home.example.com"]; h.LastError != "api unavailable" || !h.LastErrorAt.Equal(t2) {
+		t.Fatalf("got error %q at %s", h.LastError, h.LastErrorAt)
+	}
+
+	// A new address gets a new update time.
+	s.setPublished("home.example.com", recordTypeA, publishedRecord{IP: newIP, UpdatedAt: t2})
+	s.setError("home.example.com", nil, t2)
+	want = publishedRecord{IP: newIP, ID: "42", UpdatedAt: t2}
+	if got, _ := s.published("home.example.com", recordTypeA); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if h := s.Hostnames["home.example.com"]; h.LastError != "" || !h.LastErrorAt.IsZero() {
+		t.Fatalf("expected the error to be cleared, got %q", h.LastError)
+	}
+
+	s.forget("home.example.com", recordTypeA)
+	if _, ok := s.published("home.example.com", recordTypeA); ok {
+		t.Fatal("expected the record to be forgotten")
+	}
+}
+
+func TestLoadStateInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadState(path); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestNilStateFile(t *testing.T) {
+	var s *stateFile
+	s.setPublished("home.example.com", recordTypeA, publishedRecord{})
+	s.setError("home.example.com", fmt.Errorf("error"), time.Now())
+	s.forget("home.example.com", recordTypeA)
+	if _, ok := s.published("home.example.com", recordTypeA); ok {
+		t.Fatal("expected nothing published")
+	}
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateDomainsState(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	recently, before := now.Add(-time.Minute), now.Add(-time.Hour)
+	ip := netip.MustParseAddr("203.0.113.1")
+	oldIP := netip.MustParseAddr("198.51.100.1")
+	hostname := testDomain().hostname()
+	lookups := []string{"/domain/zone/example.com/record?fieldType=A&subDomain=home", "/domain/zone/example.com/record/42"}
+
+	tests := []struct {
+		name      string
+		published *publishedRecord
+		dnsIP     netip.Addr
+		putErr    error
+		wantGets  []string
+		wantPuts  int
+		wantState *publishedRecord
+	}{
+		{
+			name:      "published within the TTL",
+			published: &publishedRecord{IP: ip, ID: "42", UpdatedAt: recently},
+			wantState: &publishedRecord{IP: ip, ID: "42", UpdatedAt: recently},
+		},
+		{
+			name:      "published before the TTL",
+			published: &publishedRecord{IP: ip, ID: "42", UpdatedAt: before},
+			wantGets:  lookups,
+			wantPuts:  1,
+			wantState: &publishedRecord{IP: ip, ID: "42", UpdatedAt: now},
+		},
+		{
+			name:      "resolver up to date",
+			published: &publishedRecord{IP: ip, ID: "42", UpdatedAt: before},
+			dnsIP:     ip,
+			wantState: &publishedRecord{IP: ip, ID: "42", UpdatedAt: before},
+		},
+		{
+			name:      "stored record ID",
+			published: &publishedRecord{IP: oldIP, ID: "42", UpdatedAt: before},
+			wantPuts:  1,
+			wantState: &publishedRecord{IP: ip, ID: "42", UpdatedAt: now},
+		},
+		{
+			name:      "stale record ID",
+			published: &publishedRecord{IP: oldIP, ID: "42", UpdatedAt: before},
+			putErr:    fmt.Errorf("record not found"),
+			wantPuts:  1,
+		},
+		{
+			name:      "no state",
+			wantGets:  lookups,
+			wantPuts:  1,
+			wantState: &publishedRecord{IP: ip, ID: "42", UpdatedAt: now},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &mockOVHClient{
+				getFunc: func(url string, resType any) error {
+					if strings.Contains(url, "?") {
+						jsonInto([]int{42}, resType)
+					} else {
+						jsonInto(zoneRecord{ID: 42, FieldType: "A", Target: oldIP.String()}, resType)
+					}
+					return nil
+				},
+				putFunc: func(string, any, any) error {
+					return tc.putErr
+				},
+			}
+
+			state, err := loadState(filepath.Join(t.TempDir(), "state.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.published != nil {
+				state.setPublished(hostname, recordTypeA, *tc.published)
+			}
+
+			dns := &mockDNSProvider{addr: oldIP}
+			if tc.dnsIP.IsValid() {
+				dns.addr = tc.dnsIP
+			}
+			a := testApp(client)
+			a.clock = func() time.Time { return now }
+			a.config.Provider = testProviders
+			a.ipProvider = &mockIPProvider{addr: ip}
+			a.dnsProvider = dns
+			a.state = state
+
+			a.tryUpdateDomainsIfNeeded(context.Background())
+
+			// The resolver is checked on every cycle.
+			if len(dns.lookups) != 1 {
+				t.Fatalf("got lookups %v, want 1", dns.lookups)
+			}
+			if !slices.Equal(client.getCalls, tc.wantGets) {
+				t.Fatalf("got gets %v, want %v", client.getCalls, tc.wantGets)
+			}
+			if len(client.putCalls) != tc.wantPuts {
+				t.Fatalf("got puts %v, want %d", client.putCalls, tc.wantPuts)
+			}
+
+			// The state is saved after each check.
+			saved, err := loadState(state.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := saved.published(hostname, recordTypeA)
+			switch {
+			case tc.wantState == nil && ok:
+				t.Fatalf("expected no record, got %+v", got)
+			case tc.wantState != nil && (got.IP != tc.wantState.IP || got.ID != tc.wantState.ID ||
+				!got.UpdatedAt.Equal(tc.wantState.UpdatedAt)):
+				t.Fatalf("got %+v, want %+v", got, *tc.wantState)
+			}
+
+			if gotErr := saved.Hostnames[hostname].LastError; (tc.putErr != nil) != (gotErr != "") {
+				t.Fatalf("got last error %q", gotErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// healthMaxIntervals is the number of check intervals after which the daemon
+// is unhealthy if no check completed.
+const healthMaxIntervals = 3
+
+// recordStatus is what was last seen of a record type of a hostname.
+type recordStatus struct {
+	LocalIP    string `json:"local_ip,omitempty"`
+	DNSIP      string `json:"dns_ip,omitempty"`
+	ZoneTarget string `json:"zone_target,omitempty"`
+}
+
+// domainStatus is what was last seen of a hostname.
+type domainStatus struct {
+	Hostname    string                       `json:"hostname"`
+	Records     map[recordType]*recordStatus `json:"records"`
+	LastUpdate  time.Time                    `json:"last_update,omitzero"`
+	LastError   string                       `json:"last_error,omitempty"`
+	LastErrorAt time.Time                    `json:"last_error_at,omitzero"`
+}
+
+// statusTracker keeps the status of the hostnames served on /status. A nil
+// statusTracker records nothing.
+type statusTracker struct {
+	mu        sync.Mutex
+	lastCheck time.Time
+	domains   map[string]*domainStatus
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{domains: map[string]*domainStatus{}}
+}
+
+// record returns the status of the record type of the hostname, the caller
+// holding the lock.
+func (s *statusTracker) record(hostname string, t recordType) *recordStatus {
+	d := s.domain(hostname)
+	r, ok := d.Records[t]
+	if !ok {
+		r = &recordStatus{}
+		d.Records[t] = r
+	}
+
+	return r
+}
+
+func (s *statusTracker) domain(hostname string) *domainStatus {
+	d, ok := s.domains[hostname]
+	if !ok {
+		d = &domainStatus{Hostname: hostname, Records: map[recordType]*recordStatus{}}
+		s.domains[hostname] = d
+	}
+
+	return d
+}
+
+func (s *statusTracker) setLocalIP(hostname string, ip netip.Addr) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.record(hostname, recordTypeOf(ip)).LocalIP = ip.String()
+}
+
+func (s *statusTracker) setDNSIP(hostname string, t recordType, ip netip.Addr) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.record(hostname, t)
+	r.DNSIP = ""
+	if ip.IsValid() {
+		r.DNSIP = ip.String()
+	}
+}
+
+// setZoneTarget records the target of the record in the zone, empty if there
+// is none.
+func (s *statusTracker) setZoneTarget(hostname string, t recordType, target string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.record(hostname, t).ZoneTarget = target
+}
+
+func (s *statusTracker) setUpdated(hostname string, at time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.domain(hostname).LastUpdate = at
+}
+
+// setError records the result of the last attempt for the hostname, a nil
+// error clearing the previous one.
+func (s *statusTracker) setError(hostname string, err error, at time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := s.domain(hostname)
+	if err == nil {
+		d.LastError = ""
+		d.LastErrorAt = time.Time{}
+		return
+	}
+
+	d.LastError = err.Error()
+	d.LastErrorAt = at
+}
+
+// checkCompleted records the end of a check of all the domains.
+func (s *statusTracker) checkCompleted(at time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastCheck = at
+}
+
+func (s *statusTracker) lastCheckTime() time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastCheck
+}
+
+// snapshot returns a copy of the status of the domains, in the configuration
+// order.
+func (s *statusTracker) snapshot(domains []domain) []domainStatus {
+	statuses := make([]domainStatus, 0, len(domains))
+	if s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+
+	for _, d := range domains {
+		status := domainStatus{Hostname: d.hostname(), Records: map[recordType]*recordStatus{}}
+		if s != nil {
+			if current, ok := s.domains[d.hostname()]; ok {
+				status = *current
+				status.Records = map[recordType]*recordStatus{}
+				for t, r := range current.Records {
+					r := *r
+					status.Records[t] = &r
+				}
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// healthy returns true if a check completed recently.
+func (a *app) healthy() bool {
+	a.mu.RLock()
+	interval := a.config.CheckInterval
+	a.mu.RUnlock()
+
+	last := a.status.lastCheckTime()
+	return !last.IsZero() && a.now().Sub(last) <= healthMaxIntervals*interval
+}
+
+func (a *app) serveHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	resp := struct {
+		Healthy   bool      `json:"healthy"`
+		LastCheck time.Time `json:"last_check,omitzero"`
+	}{
+		Healthy:   a.healthy(),
+		LastCheck: a.status.lastCheckTime(),
+	}
+
+	if !resp.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (a *app) serveStatus(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	a.mu.RLock()
+	domains := a.config.Domains
+	a.mu.RUnlock()
+
+	resp := struct {
+		LastCheck time.Time      `json:"last_check,omitzero"`
+		Domains   []domainStatus `json:"domains"`
+	}{
+		LastCheck: a.status.lastCheckTime(),
+		Domains:   a.status.snapshot(domains),
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
+
+// startStatus serves /healthz and /status on the status_listen address, if
+// any, until the context is done.
+func (a *app) startStatus(ctx context.Context) error {
+	if a.config.StatusListen == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", a.serveHealthz)
+	mux.HandleFunc("/status", a.serveStatus)
+	return startHTTPServer(ctx, a.config.StatusListen, mux, "status")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name      string
+		lastCheck time.Time
+		want      int
+	}{
+		{
+			name: "no check yet",
+			want: http.StatusServiceUnavailable,
+		},
+		{
+			name:      "recent check",
+			lastCheck: now.Add(-2 * time.Minute),
+			want:      http.StatusOK,
+		},
+		{
+			name:      "stale check",
+			lastCheck: now.Add(-healthMaxIntervals*time.Minute - time.Second),
+			want:      http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &app{
+				config: config{CheckInterval: time.Minute},
+				status: newStatusTracker(),
+				clock:  func() time.Time { return now },
+			}
+			if !tc.lastCheck.IsZero() {
+				a.status.checkCompleted(tc.lastCheck)
+			}
+
+			rec := httptest.NewRecorder()
+			a.serveHealthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+
+			if rec.Code != tc.want {
+				t.Fatalf("got status %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+	oldIP := netip.MustParseAddr("198.51.100.1")
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	home := testDomain()
+	failing := domain{Domain: "example.com", SubDomain: "failing", Provider: "missing"}
+	idle := domain{Domain: "example.com", SubDomain: "idle", RecordTypes: []recordType{recordTypeAAAA}}
+
+	backend := newMockBackend()
+	backend.records[mockBackendKey(home, recordTypeA)] = record{ID: "1", Type: recordTypeA, Target: oldIP.String()}
+	a := &app{
+		config: config{
+			Provider:      testProviders,
+			CheckInterval: time.Minute,
+			Domains:       []domain{home, failing, idle},
+		},
+		backends:    map[string]DNSBackend{defaultBackend: backend},
+		ipProvider:  &ipv4OnlyProvider{addr: ip},
+		dnsProvider: &mockDNSProvider{addr: oldIP},
+		status:      newStatusTracker(),
+		clock:       func() time.Time { return now },
+	}
+
+	a.tryUpdateDomainsIfNeeded(context.Background())
+
+	rec := httptest.NewRecorder()
+	a.serveStatus(rec, httptest.NewRequest("GET", "/status", nil))
+
+	var got struct {
+		LastCheck time.Time      `json:"last_check"`
+		Domains   []domainStatus `json:"domains"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !got.LastCheck.Equal(now) {
+		t.Fatalf("got last check %s, want %s", got.LastCheck, now)
+	}
+	if len(got.Domains) != 3 {
+		t.Fatalf("got %d domains, want 3", len(got.Domains))
+	}
+
+	want := recordStatus{LocalIP: ip.String(), DNSIP: oldIP.String(), ZoneTarget: ip.String()}
+	if d := got.Domains[0]; d.Hostname != home.hostname() || *d.Records[recordTypeA] != want ||
+		!d.LastUpdate.Equal(now) || d.LastError != "" {
+		t.Fatalf("got %+v, want %+v updated at %s", d, want, now)
+	}
+
+	if d := got.Domains[1]; d.Hostname != failing.hostname() || d.LastError == "" || !d.LastErrorAt.Equal(now) {
+		t.Fatalf("got %+v, want an error", d)
+	}
+
+	if d := got.Domains[2]; d.Hostname != idle.hostname() || len(d.Records) != 0 || d.LastError == "" {
+		t.Fatalf("got %+v, want the IPv6 error only", d)
+	}
+}
+
+// ipv4OnlyProvider fails to return an IPv6 address.
+type ipv4OnlyProvider struct {
+	addr netip.Addr
+}
+
+func (p *ipv4OnlyProvider) Get(_ context.Context, _ ipSource, t recordType) (netip.Addr, error) {
+	if t != recordTypeA {
+		return netip.Addr{}, fmt.Errorf("no %s address", t)
+	}
+
+	return p.addr, nil
+}
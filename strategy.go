@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type providerStrategy string
+
+const (
+	// strategyFirstSuccess tries each provider in order and uses the first
+	// valid answer.
+	strategyFirstSuccess providerStrategy = "first_success"
+	// strategyQuorum queries all the providers in parallel and only uses an
+	// address a strict majority of them agree on.
+	strategyQuorum providerStrategy = "quorum"
+)
+
+func (s providerStrategy) valid() bool {
+	return s == "" || s == strategyFirstSuccess || s == strategyQuorum
+}
+
+// providerList is an ordered list of IP providers. It can be configured as a
+// single value or as a list.
+type providerList []ipSource
+
+func (l *providerList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.SequenceNode {
+		var source ipSource
+		if err := value.Decode(&source); err != nil {
+			return err
+		}
+
+		*l = providerList{source}
+		return nil
+	}
+
+	var list []ipSource
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+
+	*l = list
+	return nil
+}
+
+// fetchIP returns the current IP for the record type, using the configured
+// providers and strategy.
+func (a *app) fetchIP(ctx context.Context, t recordType) (netip.Addr, error) {
+	if len(a.config.Provider) == 0 {
+		return netip.Addr{}, fmt.Errorf("no IP provider configured")
+	}
+
+	if a.config.ProviderStrategy == strategyQuorum {
+		return a.fetchIPQuorum(ctx, t)
+	}
+
+	return a.fetchIPFirstSuccess(ctx, t)
+}
+
+// getIP queries the provider, recording its latency and errors.
+func (a *app) getIP(ctx context.Context, provider ipSource, t recordType) (netip.Addr, error) {
+	start := time.Now()
+	ip, err := a.ipProvider.Get(ctx, provider, t)
+	a.metrics.observeIPProvider(provider, t, time.Since(start), err)
+	return ip, err
+}
+
+func (a *app) fetchIPFirstSuccess(ctx context.Context, t recordType) (netip.Addr, error) {
+	var errs []error
+	for _, provider := range a.config.Provider {
+		ip, err := a.getIP(ctx, provider, t)
+		if err == nil && !ip.IsValid() {
+			err = fmt.Errorf("got invalid IP")
+		}
+
+		if err != nil {
+			slog.WarnContext(ctx, "IP provider failed", "provider", provider.URL, "type", t, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", provider, err))
+			continue
+		}
+
+		if len(errs) > 0 {
+			slog.InfoContext(ctx, "using the IP of a fallback provider", "provider", provider.URL, "type", t, "ip", ip)
+		}
+
+		return ip, nil
+	}
+
+	return netip.Addr{}, fmt.Errorf("all providers failed: %w", errors.Join(errs...))
+}
+
+func (a *app) fetchIPQuorum(ctx context.Context, t recordType) (netip.Addr, error) {
+	providers := a.config.Provider
+	ips := make([]netip.Addr, len(providers))
+
+	var wg sync.WaitGroup
+	for i, provider := range providers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ip, err := a.getIP(ctx, provider, t)
+			if err != nil {
+				slog.WarnContext(ctx, "IP provider failed", "provider", provider.URL, "type", t, "error", err)
+				return
+			}
+			ips[i] = ip
+		}()
+	}
+	wg.Wait()
+
+	votes := map[netip.Addr]int{}
+	for _, ip := range ips {
+		if ip.IsValid() {
+			votes[ip]++
+		}
+	}
+
+	for ip, count := range votes {
+		if count > len(providers)/2 {
+			slog.InfoContext(ctx, "quorum reached", "type", t, "ip", ip,
+				"votes", count, "providers", len(providers))
+			return ip, nil
+		}
+	}
+
+	slog.WarnContext(ctx, "no quorum reached", "type", t, "providers", len(providers), "votes", fmt.Sprint(votes))
+	return netip.Addr{}, fmt.Errorf("no quorum reached among %d providers", len(providers))
+}
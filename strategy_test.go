@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mockProviders answers with a different result for each provider.
+type mockProviders struct {
+	mu    sync.Mutex
+	addrs map[string]netip.Addr
+	gets  []string
+}
+
+func (m *mockProviders) Get(_ context.Context, provider ipSource, _ recordType) (netip.Addr, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.gets = append(m.gets, provider.URL)
+	addr, ok := m.addrs[provider.URL]
+	if !ok {
+		return addr, fmt.Errorf("connection refused")
+	}
+	return addr, nil
+}
+
+// sources returns a provider list of the given URLs.
+func sources(urls ...string) providerList {
+	list := make(providerList, 0, len(urls))
+	for _, u := range urls {
+		list = append(list, ipSource{URL: u})
+	}
+	return list
+}
+
+func TestProviderListUnmarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    providerList
+		wantErr bool
+	}{
+		{
+			name: "single provider",
+			yaml: "provider: http://a.test",
+			want: sources("http://a.test"),
+		},
+		{
+			name: "provider list",
+			yaml: "provider: [http://a.test, http://b.test]",
+			want: sources("http://a.test", "http://b.test"),
+		},
+		{
+			name: "structured provider",
+			yaml: "provider: {url: http://a.test, json: ip}",
+			want: providerList{{URL: "http://a.test", JSON: "ip"}},
+		},
+		{
+			name: "mixed provider list",
+			yaml: "provider: [http://a.test, {url: http://b.test, regexp: 'IP: (\\S+)'}]",
+			want: providerList{{URL: "http://a.test"}, {URL: "http://b.test", Regexp: `IP: (\S+)`}},
+		},
+		{
+			name:    "missing url",
+			yaml:    "provider: {json: ip}",
+			wantErr: true,
+		},
+		{
+			name:    "invalid regexp",
+			yaml:    "provider: {url: http://a.test, regexp: '('}",
+			wantErr: true,
+		},
+		{
+			name:    "regexp without capture group",
+			yaml:    "provider: {url: http://a.test, regexp: '[0-9.]+'}",
+			wantErr: true,
+		},
+		{
+			name:    "json and regexp",
+			yaml:    "provider: {url: http://a.test, json: ip, regexp: '(.*)'}",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var cfg config
+			err := yaml.Unmarshal([]byte(tc.yaml), &cfg)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(cfg.Provider) != len(tc.want) {
+				t.Fatalf("got %v, want %v", cfg.Provider, tc.want)
+			}
+			for i, want := range tc.want {
+				got := cfg.Provider[i]
+				if got.URL != want.URL || got.JSON != want.JSON || got.Regexp != want.Regexp {
+					t.Fatalf("got %+v, want %+v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchIP(t *testing.T) {
+	ip := netip.MustParseAddr("203.0.113.1")
+	otherIP := netip.MustParseAddr("198.51.100.1")
+
+	tests := []struct {
+		name      string
+		strategy  providerStrategy
+		providers providerList
+		addrs     map[string]netip.Addr
+		wantAddr  netip.Addr
+		wantGets  int
+		wantErr   bool
+	}{
+		{
+			name:      "first success uses the first provider",
+			providers: sources("a", "b"),
+			addrs:     map[string]netip.Addr{"a": ip, "b": otherIP},
+			wantAddr:  ip,
+			wantGets:  1,
+		},
+		{
+			name:      "first success falls back",
+			strategy:  strategyFirstSuccess,
+			providers: sources("a", "b", "c"),
+			addrs:     map[string]netip.Addr{"b": ip, "c": otherIP},
+			wantAddr:  ip,
+			wantGets:  2,
+		},
+		{
+			name:      "first success skips invalid addresses",
+			providers: sources("a", "b"),
+			addrs:     map[string]netip.Addr{"a": {}, "b": ip},
+			wantAddr:  ip,
+			wantGets:  2,
+		},
+		{
+			name:      "first success all failed",
+			providers: sources("a", "b"),
+			wantGets:  2,
+			wantErr:   true,
+		},
+		{
+			name:      "quorum reached",
+			strategy:  strategyQuorum,
+			providers: sources("a", "b", "c"),
+			addrs:     map[string]netip.Addr{"a": otherIP, "b": ip, "c": ip},
+			wantAddr:  ip,
+			wantGets:  3,
+		},
+		{
+			name:      "quorum reached despite a failure",
+			strategy:  strategyQuorum,
+			providers: sources("a", "b", "c"),
+			addrs:     map[string]netip.Addr{"b": ip, "c": ip},
+			wantAddr:  ip,
+			wantGets:  3,
+		},
+		{
+			name:      "no quorum on disagreement",
+			strategy:  strategyQuorum,
+			providers: sources("a", "b"),
+			addrs:     map[string]netip.Addr{"a": ip, "b": otherIP},
+			wantGets:  2,
+			wantErr:   true,
+		},
+		{
+			name:      "no quorum with too many failures",
+			strategy:  strategyQuorum,
+			providers: sources("a", "b", "c"),
+			addrs:     map[string]netip.Addr{"a": ip},
+			wantGets:  3,
+			wantErr:   true,
+		},
+		{
+			name:     "no providers",
+			wantErr:  true,
+			wantGets: 0,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := &mockProviders{addrs: tc.addrs}
+			a := &app{
+				config: config{
+					Provider:         tc.providers,
+					ProviderStrategy: tc.strategy,
+				},
+				ipProvider: mock,
+			}
+
+			addr, err := a.fetchIP(context.Background(), recordTypeA)
+
+			if len(mock.gets) != tc.wantGets {
+				t.Fatalf("got %d provider calls, want %d", len(mock.gets), tc.wantGets)
+			}
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if addr != tc.wantAddr {
+				t.Fatalf("got %v, want %v", addr, tc.wantAddr)
+			}
+		})
+	}
+}
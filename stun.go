@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"time"
+)
+
+// STUN constants, as defined in RFC 5389.
+const (
+	stunHeaderSize        = 20
+	stunMagicCookie       = 0x2112A442
+	stunBindingRequest    = 0x0001
+	stunBindingResponse   = 0x0101
+	stunBindingError      = 0x0111
+	stunAttrMappedAddress = 0x0001
+	stunAttrXORMapped     = 0x0020
+	stunFamilyIPv4        = 0x01
+	stunFamilyIPv6        = 0x02
+)
+
+// stunAttempts is the number of binding requests sent before giving up, each
+// waiting for stunTimeout.
+const (
+	stunAttempts = 3
+	stunTimeout  = time.Second
+)
+
+// stunProvider learns the public IP by sending a STUN binding request, it is
+// configured as stun://HOST[:PORT]. The address returned is the one mapped by
+// the NAT for UDP traffic.
+type stunProvider struct{}
+
+func newSTUNProvider() *stunProvider {
+	return &stunProvider{}
+}
+
+func (p *stunProvider) Get(ctx context.Context, provider ipSource, t recordType) (netip.Addr, error) {
+	var addr netip.Addr
+	u, err := url.Parse(provider.URL)
+	if err != nil {
+		return addr, err
+	}
+
+	if u.Hostname() == "" {
+		return addr, fmt.Errorf("missing STUN server in %q", provider.URL)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "3478"
+	}
+
+	network := "udp4"
+	if t == recordTypeAAAA {
+		network = "udp6"
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return addr, err
+	}
+	defer conn.Close()
+
+	mapped, err := stunBinding(ctx, conn)
+	if err != nil {
+		return addr, err
+	}
+
+	addr = mapped.Addr().Unmap()
+	if !t.match(addr) {
+		return addr, fmt.Errorf("got %s from STUN server, expected an %s address", addr, t)
+	}
+
+	return addr, nil
+}
+
+// stunBinding sends binding requests on the connection until a response is
+// received and returns the mapped address.
+func stunBinding(ctx context.Context, conn net.Conn) (netip.AddrPort, error) {
+	txID, req, err := newSTUNRequest()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	buf := make([]byte, 1500)
+	for range stunAttempts {
+		deadline := time.Now().Add(stunTimeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetDeadline(deadline)
+
+		if _, err := conn.Write(req); err != nil {
+			return netip.AddrPort{}, err
+		}
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() == nil {
+					// Retransmit the request
+					break
+				}
+				return netip.AddrPort{}, err
+			}
+
+			mapped, err := parseSTUNResponse(buf[:n], txID)
+			if errors.Is(err, errSTUNUnexpected) {
+				// Stray packet, keep waiting for our response
+				continue
+			}
+
+			return mapped, err
+		}
+	}
+
+	return netip.AddrPort{}, fmt.Errorf("no response from STUN server after %d attempts", stunAttempts)
+}
+
+var errSTUNUnexpected = errors.New("unexpected STUN message")
+
+// newSTUNRequest returns a binding request along with its transaction ID.
+func newSTUNRequest() ([12]byte, []byte, error) {
+	var txID [12]byte
+	if _, err := rand.Read(txID[:]); err != nil {
+		return txID, nil, err
+	}
+
+	req := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(req[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint16(req[2:4], 0)
+	binary.BigEndian.PutUint32(req[4:8], stunMagicCookie)
+	copy(req[8:20], txID[:])
+	return txID, req, nil
+}
+
+// parseSTUNResponse returns the address found in a binding response,
+// preferring the XOR-MAPPED-ADDRESS attribute over the legacy MAPPED-ADDRESS.
+func parseSTUNResponse(msg []byte, txID [12]byte) (netip.AddrPort, error) {
+	var mapped netip.AddrPort
+	if len(msg) < stunHeaderSize ||
+		binary.BigEndian.Uint32(msg[4:8]) != stunMagicCookie ||
+		[12]byte(msg[8:20]) != txID {
+		return mapped, errSTUNUnexpected
+	}
+
+	msgType := binary.BigEndian.Uint16(msg[0:2])
+	switch msgType {
+	case stunBindingResponse:
+	case stunBindingError:
+		return mapped, fmt.Errorf("STUN server returned an error response")
+	default:
+		return mapped, errSTUNUnexpected
+	}
+
+	length := int(binary.BigEndian.Uint16(msg[2:4]))
+	if len(msg) < stunHeaderSize+length {
+		return mapped, fmt.Errorf("truncated STUN response")
+	}
+
+	attrs := msg[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+attrLen {
+			return mapped, fmt.Errorf("truncated STUN attribute")
+		}
+		value := attrs[4 : 4+attrLen]
+
+		switch attrType {
+		case stunAttrXORMapped:
+			return parseSTUNAddress(value, msg[4:20])
+		case stunAttrMappedAddress:
+			var err error
+			if mapped, err = parseSTUNAddress(value, nil); err != nil {
+				return mapped, err
+			}
+		}
+
+		// Attributes are padded to a multiple of 4 bytes
+		padded := (attrLen + 3) &^ 3
+		if len(attrs) < 4+padded {
+			break
+		}
+		attrs = attrs[4+padded:]
+	}
+
+	if !mapped.IsValid() {
+		return mapped, fmt.Errorf("no mapped address in STUN response")
+	}
+
+	return mapped, nil
+}
+
+// parseSTUNAddress parses a (XOR-)MAPPED-ADDRESS attribute value. The xor key
+// is the magic cookie followed by the transaction ID, nil when the address is
+// not obfuscated.
+func parseSTUNAddress(value, xor []byte) (netip.AddrPort, error) {
+	if len(value) < 4 {
+		return netip.AddrPort{}, fmt.Errorf("invalid STUN address attribute")
+	}
+
+	var size int
+	switch value[1] {
+	case stunFamilyIPv4:
+		size = 4
+	case stunFamilyIPv6:
+		size = 16
+	default:
+		return netip.AddrPort{}, fmt.Errorf("invalid STUN address family %d", value[1])
+	}
+
+	if len(value) < 4+size {
+		return netip.AddrPort{}, fmt.Errorf("invalid STUN address attribute")
+	}
+
+	port := binary.BigEndian.Uint16(value[2:4])
+	raw := make([]byte, size)
+	copy(raw, value[4:4+size])
+	if xor != nil {
+		port ^= stunMagicCookie >> 16
+		for i := range raw {
+			raw[i] ^= xor[i]
+		}
+	}
+
+	addr, _ := netip.AddrFromSlice(raw)
+	return netip.AddrPortFrom(addr, port), nil
+}
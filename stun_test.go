@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// testSTUNServer starts a UDP STUN server answering binding requests with the
+// message built by the handler, or nothing if it returns nil.
+func testSTUNServer(t *testing.T, handler func(req []byte, from netip.AddrPort) []byte) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			if n < stunHeaderSize || binary.BigEndian.Uint16(buf[0:2]) != stunBindingRequest {
+				continue
+			}
+
+			from := addr.(*net.UDPAddr).AddrPort()
+			if resp := handler(buf[:n], from); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// stunMessage builds a STUN message answering the request with the given type
+// and address attribute.
+func stunMessage(req []byte, msgType, attrType uint16, mapped netip.AddrPort) []byte {
+	value := []byte{0, stunFamilyIPv4}
+	raw := mapped.Addr().AsSlice()
+	if mapped.Addr().Is6() {
+		value[1] = stunFamilyIPv6
+	}
+
+	port := mapped.Port()
+	if attrType == stunAttrXORMapped {
+		port ^= stunMagicCookie >> 16
+		for i := range raw {
+			raw[i] ^= req[4+i]
+		}
+	}
+	value = binary.BigEndian.AppendUint16(value, port)
+	value = append(value, raw...)
+
+	msg := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(msg[0:2], msgType)
+	copy(msg[4:20], req[4:20])
+
+	// Unknown attribute with padding, which must be skipped
+	msg = binary.BigEndian.AppendUint16(msg, 0x8022)
+	msg = binary.BigEndian.AppendUint16(msg, 3)
+	msg = append(msg, 'g', 'o', '!', 0)
+
+	if attrType != 0 {
+		msg = binary.BigEndian.AppendUint16(msg, attrType)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(value)))
+		msg = append(msg, value...)
+	}
+
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)-stunHeaderSize))
+	return msg
+}
+
+func TestSTUNProviderGet(t *testing.T) {
+	mapped := netip.MustParseAddrPort("203.0.113.1:51820")
+
+	tests := []struct {
+		name     string
+		handler  func(req []byte, from netip.AddrPort) []byte
+		rt       recordType
+		wantAddr netip.Addr
+		wantErr  bool
+	}{
+		{
+			name: "xor mapped address",
+			handler: func(req []byte, _ netip.AddrPort) []byte {
+				return stunMessage(req, stunBindingResponse, stunAttrXORMapped, mapped)
+			},
+			wantAddr: mapped.Addr(),
+		},
+		{
+			name: "sender address",
+			handler: func(req []byte, from netip.AddrPort) []byte {
+				return stunMessage(req, stunBindingResponse, stunAttrXORMapped, from)
+			},
+			wantAddr: netip.MustParseAddr("127.0.0.1"),
+		},
+		{
+			name: "legacy mapped address",
+			handler: func(req []byte, _ netip.AddrPort) []byte {
+				return stunMessage(req, stunBindingResponse, stunAttrMappedAddress, mapped)
+			},
+			wantAddr: mapped.Addr(),
+		},
+		{
+			name: "response to another transaction",
+			handler: func(req []byte, _ netip.AddrPort) []byte {
+				other := make([]byte, len(req))
+				copy(other, req)
+				other[19] ^= 0xff
+				return stunMessage(other, stunBindingResponse, stunAttrXORMapped, mapped)
+			},
+			wantErr: true,
+		},
+		{
+			name: "error response",
+			handler: func(req []byte, _ netip.AddrPort) []byte {
+				return stunMessage(req, stunBindingError, 0, netip.AddrPort{})
+			},
+			wantErr: true,
+		},
+		{
+			name: "no mapped address",
+			handler: func(req []byte, _ netip.AddrPort) []byte {
+				return stunMessage(req, stunBindingResponse, 0, netip.AddrPort{})
+			},
+			wantErr: true,
+		},
+		{
+			name: "no response",
+			handler: func(req []byte, _ netip.AddrPort) []byte {
+				return nil
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := testSTUNServer(t, tc.handler)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			p := newSTUNProvider()
+			got, err := p.Get(ctx, ipSource{URL: "stun://" + addr}, recordTypeA)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.wantAddr {
+				t.Fatalf("got %v, want %v", got, tc.wantAddr)
+			}
+		})
+	}
+}
+
+func TestParseSTUNResponseIPv6(t *testing.T) {
+	mapped := netip.MustParseAddrPort("[2001:db8::1]:3478")
+	txID, req, err := newSTUNRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := stunMessage(req, stunBindingResponse, stunAttrXORMapped, mapped)
+	got, err := parseSTUNResponse(resp, txID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got != mapped {
+		t.Fatalf("got %v, want %v", got, mapped)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TSIG constants, as defined in RFC 8945.
+const (
+	tsigType          = dnsmessage.Type(250)
+	tsigFudge         = 300
+	tsigHMACSHA256    = "hmac-sha256."
+	tsigErrBadSig     = 16
+	tsigErrBadKey     = 17
+	tsigErrBadTime    = 18
+	dnsHeaderSize     = 12
+	dnsRRFixedSize    = 10
+	dnsQuestionFixed  = 4
+	dnsCompressionBit = 0xC0
+)
+
+var errTSIGMissing = errors.New("message is not signed")
+
+// tsigKey signs and verifies DNS messages using a shared secret.
+type tsigKey struct {
+	name      string
+	algorithm string
+	secret    []byte
+}
+
+// newTSIGKey returns a key from its name, algorithm and base64 encoded
+// secret. Only hmac-sha256 is supported.
+func newTSIGKey(name, algorithm, secret string) (*tsigKey, error) {
+	if name == "" {
+		return nil, fmt.Errorf("missing TSIG key name")
+	}
+
+	algorithm = strings.ToLower(strings.TrimSuffix(algorithm, ".") + ".")
+	if algorithm == "." {
+		algorithm = tsigHMACSHA256
+	}
+	if algorithm != tsigHMACSHA256 {
+		return nil, fmt.Errorf("unsupported TSIG algorithm %q", algorithm)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSIG secret: %w", err)
+	}
+
+	return &tsigKey{
+		name:      strings.ToLower(strings.TrimSuffix(name, ".") + "."),
+		algorithm: algorithm,
+		secret:    raw,
+	}, nil
+}
+
+// tsigVariables are the TSIG fields covered by the MAC.
+type tsigVariables struct {
+	signed time.Time
+	fudge  uint16
+	err    uint16
+	other  []byte
+}
+
+// mac computes the MAC of an unsigned message. Responses also cover the MAC
+// of the request.
+func (k *tsigKey) mac(msg, requestMAC []byte, v tsigVariables) []byte {
+	h := hmac.New(sha256.New, k.secret)
+	if requestMAC != nil {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(requestMAC))))
+		h.Write(requestMAC)
+	}
+
+	h.Write(msg)
+	h.Write(wireName(k.name))
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(dnsmessage.ClassANY)))
+	h.Write(binary.BigEndian.AppendUint32(nil, 0))
+	h.Write(wireName(k.algorithm))
+	h.Write(appendTime48(nil, v.signed))
+	h.Write(binary.BigEndian.AppendUint16(nil, v.fudge))
+	h.Write(binary.BigEndian.AppendUint16(nil, v.err))
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(v.other))))
+	h.Write(v.other)
+	return h.Sum(nil)
+}
+
+// sign appends a TSIG record to the packed message and returns the signed
+// message along with its MAC. requestMAC is nil when signing a request.
+func (k *tsigKey) sign(msg, requestMAC []byte, now time.Time) ([]byte, []byte) {
+	v := tsigVariables{signed: now, fudge: tsigFudge}
+	mac := k.mac(msg, requestMAC, v)
+
+	rdata := wireName(k.algorithm)
+	rdata = appendTime48(rdata, v.signed)
+	rdata = binary.BigEndian.AppendUint16(rdata, v.fudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(mac)))
+	rdata = append(rdata, mac...)
+	rdata = append(rdata, msg[0:2]...) // Original ID
+	rdata = binary.BigEndian.AppendUint16(rdata, v.err)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0) // Other length
+
+	signed := make([]byte, len(msg), len(msg)+len(k.name)+dnsRRFixedSize+len(rdata)+1)
+	copy(signed, msg)
+	signed = append(signed, wireName(k.name)...)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(tsigType))
+	signed = binary.BigEndian.AppendUint16(signed, uint16(dnsmessage.ClassANY))
+	signed = binary.BigEndian.AppendUint32(signed, 0)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(rdata)))
+	signed = append(signed, rdata...)
+
+	arcount := binary.BigEndian.Uint16(signed[10:12])
+	binary.BigEndian.PutUint16(signed[10:12], arcount+1)
+	return signed, mac
+}
+
+// verify checks the TSIG record at the end of the message and returns its
+// MAC. requestMAC is nil when verifying a request.
+func (k *tsigKey) verify(msg, requestMAC []byte, now time.Time) ([]byte, error) {
+	offset, err := tsigOffset(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return nil, err
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return nil, err
+	}
+	additionals, err := p.AllAdditionals()
+	if err != nil {
+		return nil, err
+	}
+
+	rr := additionals[len(additionals)-1]
+	body, ok := rr.Body.(*dnsmessage.UnknownResource)
+	if !ok || rr.Header.Type != tsigType {
+		return nil, errTSIGMissing
+	}
+
+	if !strings.EqualFold(rr.Header.Name.String(), k.name) {
+		return nil, fmt.Errorf("message signed with unknown key %s", rr.Header.Name)
+	}
+
+	algorithm, rdata, err := readWireName(body.Data)
+	if err != nil || !strings.EqualFold(algorithm, k.algorithm) {
+		return nil, fmt.Errorf("unexpected TSIG algorithm %q", algorithm)
+	}
+
+	if len(rdata) < 10 {
+		return nil, fmt.Errorf("truncated TSIG record")
+	}
+	v := tsigVariables{
+		signed: readTime48(rdata[0:6]),
+		fudge:  binary.BigEndian.Uint16(rdata[6:8]),
+	}
+	macSize := int(binary.BigEndian.Uint16(rdata[8:10]))
+	rdata = rdata[10:]
+	if len(rdata) < macSize+6 {
+		return nil, fmt.Errorf("truncated TSIG record")
+	}
+	mac := rdata[:macSize]
+	originalID := rdata[macSize : macSize+2]
+	v.err = binary.BigEndian.Uint16(rdata[macSize+2 : macSize+4])
+	otherSize := int(binary.BigEndian.Uint16(rdata[macSize+4 : macSize+6]))
+	if len(rdata) < macSize+6+otherSize {
+		return nil, fmt.Errorf("truncated TSIG record")
+	}
+	v.other = rdata[macSize+6 : macSize+6+otherSize]
+
+	switch v.err {
+	case 0:
+	case tsigErrBadSig:
+		return nil, fmt.Errorf("TSIG signature rejected by the server")
+	case tsigErrBadKey:
+		return nil, fmt.Errorf("TSIG key %s rejected by the server", k.name)
+	case tsigErrBadTime:
+		return nil, fmt.Errorf("TSIG time rejected by the server, check the clock")
+	default:
+		return nil, fmt.Errorf("TSIG error %d", v.err)
+	}
+
+	// The MAC covers the message without the TSIG record and with its
+	// original ID.
+	unsigned := make([]byte, offset)
+	copy(unsigned, msg[:offset])
+	copy(unsigned[0:2], originalID)
+	arcount := binary.BigEndian.Uint16(unsigned[10:12])
+	binary.BigEndian.PutUint16(unsigned[10:12], arcount-1)
+
+	if !hmac.Equal(mac, k.mac(unsigned, requestMAC, v)) {
+		return nil, fmt.Errorf("invalid TSIG signature")
+	}
+
+	if d := now.Sub(v.signed); d > time.Duration(v.fudge)*time.Second || -d > time.Duration(v.fudge)*time.Second {
+		return nil, fmt.Errorf("TSIG signature time %s is out of the allowed window", v.signed)
+	}
+
+	return mac, nil
+}
+
+// tsigOffset returns the offset of the last additional record of the
+// message, where the TSIG record must be.
+func tsigOffset(msg []byte) (int, error) {
+	if len(msg) < dnsHeaderSize {
+		return 0, fmt.Errorf("truncated DNS message")
+	}
+
+	if binary.BigEndian.Uint16(msg[10:12]) == 0 {
+		return 0, errTSIGMissing
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:8])) +
+		int(binary.BigEndian.Uint16(msg[8:10])) +
+		int(binary.BigEndian.Uint16(msg[10:12]))
+
+	off := dnsHeaderSize
+	var err error
+	for range qdcount {
+		if off, err = skipWireName(msg, off); err != nil {
+			return 0, err
+		}
+		off += dnsQuestionFixed
+	}
+
+	for range rrcount - 1 {
+		if off, err = skipWireName(msg, off); err != nil {
+			return 0, err
+		}
+		if len(msg) < off+dnsRRFixedSize {
+			return 0, fmt.Errorf("truncated DNS message")
+		}
+		off += dnsRRFixedSize + int(binary.BigEndian.Uint16(msg[off+8:off+10]))
+	}
+
+	if off >= len(msg) {
+		return 0, fmt.Errorf("truncated DNS message")
+	}
+
+	return off, nil
+}
+
+// skipWireName returns the offset following the possibly compressed name
+// found at the given offset.
+func skipWireName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, fmt.Errorf("truncated DNS name")
+		}
+
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+		case length&dnsCompressionBit == dnsCompressionBit:
+			return off + 2, nil
+		default:
+			off += length + 1
+		}
+	}
+}
+
+// readWireName reads an uncompressed name and returns it along with the
+// remaining data.
+func readWireName(data []byte) (string, []byte, error) {
+	var labels []string
+	for {
+		if len(data) == 0 {
+			return "", nil, fmt.Errorf("truncated DNS name")
+		}
+
+		length := int(data[0])
+		if length == 0 {
+			return strings.Join(labels, ".") + ".", data[1:], nil
+		}
+
+		if length&dnsCompressionBit != 0 || len(data) < length+1 {
+			return "", nil, fmt.Errorf("invalid DNS name")
+		}
+
+		labels = append(labels, string(data[1:length+1]))
+		data = data[length+1:]
+	}
+}
+
+// wireName returns the canonical wire format of a fully qualified name.
+func wireName(name string) []byte {
+	var wire []byte
+	for _, label := range strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".") {
+		if label == "" {
+			continue
+		}
+		wire = append(wire, byte(len(label)))
+		wire = append(wire, label...)
+	}
+
+	return append(wire, 0)
+}
+
+func appendTime48(b []byte, t time.Time) []byte {
+	secs := uint64(t.Unix())
+	return append(b, byte(secs>>40), byte(secs>>32), byte(secs>>24), byte(secs>>16), byte(secs>>8), byte(secs))
+}
+
+func readTime48(b []byte) time.Time {
+	var secs uint64
+	for _, c := range b[:6] {
+		secs = secs<<8 | uint64(c)
+	}
+
+	return time.Unix(int64(secs), 0)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testTSIGSecret = "c2VjcmV0LXNoYXJlZC13aXRoLXRoZS1uYW1lc2VydmVy"
+
+func testTSIGKey(t *testing.T, secret string) *tsigKey {
+	t.Helper()
+
+	key, err := newTSIGKey("waybackd", "", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestNewTSIGKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		algorithm string
+		secret    string
+		wantErr   bool
+	}{
+		{name: "default algorithm", key: "waybackd", secret: testTSIGSecret},
+		{name: "explicit algorithm", key: "waybackd.", algorithm: "HMAC-SHA256", secret: testTSIGSecret},
+		{name: "missing name", secret: testTSIGSecret, wantErr: true},
+		{name: "unsupported algorithm", key: "waybackd", algorithm: "hmac-md5.sig-alg.reg.int", secret: testTSIGSecret, wantErr: true},
+		{name: "invalid secret", key: "waybackd", secret: "not base64!", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := newTSIGKey(tc.key, tc.algorithm, tc.secret)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if key.name != "waybackd." || key.algorithm != tsigHMACSHA256 {
+				t.Fatalf("got key %s with algorithm %s", key.name, key.algorithm)
+			}
+		})
+	}
+}
+
+func TestTSIGSignVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	msg, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 42, OpCode: dnsOpCodeUpdate},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Type:  dnsmessage.TypeSOA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		msg        func(key *tsigKey) []byte
+		verifyKey  string
+		requestMAC []byte
+		now        time.Time
+		wantErr    bool
+	}{
+		{
+			name: "valid signature",
+			msg: func(key *tsigKey) []byte {
+				signed, _ := key.sign(msg, nil, now)
+				return signed
+			},
+		},
+		{
+			name: "valid response signature",
+			msg: func(key *tsigKey) []byte {
+				signed, _ := key.sign(msg, []byte("request"), now)
+				return signed
+			},
+			requestMAC: []byte("request"),
+		},
+		{
+			name: "response to another request",
+			msg: func(key *tsigKey) []byte {
+				signed, _ := key.sign(msg, []byte("request"), now)
+				return signed
+			},
+			requestMAC: []byte("other"),
+			wantErr:    true,
+		},
+		{
+			name: "tampered message",
+			msg: func(key *tsigKey) []byte {
+				signed, _ := key.sign(msg, nil, now)
+				signed[dnsHeaderSize+1]++ // Question name
+				return signed
+			},
+			wantErr: true,
+		},
+		{
+			name: "other secret",
+			msg: func(key *tsigKey) []byte {
+				signed, _ := key.sign(msg, nil, now)
+				return signed
+			},
+			verifyKey: "b3RoZXItc2VjcmV0",
+			wantErr:   true,
+		},
+		{
+			name: "signature too old",
+			msg: func(key *tsigKey) []byte {
+				signed, _ := key.sign(msg, nil, now)
+				return signed
+			},
+			now:     now.Add(10 * time.Minute),
+			wantErr: true,
+		},
+		{
+			name:    "unsigned message",
+			msg:     func(*tsigKey) []byte { return msg },
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			key := testTSIGKey(t, testTSIGSecret)
+			verifyKey := key
+			if tc.verifyKey != "" {
+				verifyKey = testTSIGKey(t, tc.verifyKey)
+			}
+
+			verifyNow := tc.now
+			if verifyNow.IsZero() {
+				verifyNow = now
+			}
+
+			_, err := verifyKey.verify(tc.msg(key), tc.requestMAC, verifyNow)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
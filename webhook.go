@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Webhook event names.
+const (
+	// webhookEventUpdate is sent when a record target changed.
+	webhookEventUpdate = "update"
+	// webhookEventFailure is sent once a hostname failed a number of times
+	// in a row.
+	webhookEventFailure = "failure"
+)
+
+const (
+	defaultWebhookFailures = 3
+	webhookTimeout         = 10 * time.Second
+	webhookAttempts        = 4
+	webhookRetryDelay      = 2 * time.Second
+	webhookMaxBodySize     = 4 << 10
+)
+
+// webhookEvent is sent as JSON, or used as the data of the body template.
+type webhookEvent struct {
+	Event    string     `json:"event"`
+	Hostname string     `json:"hostname"`
+	Type     recordType `json:"type,omitempty"`
+	OldIP    string     `json:"old_ip,omitempty"`
+	NewIP    string     `json:"new_ip,omitempty"`
+	Time     time.Time  `json:"time"`
+	// Result is success or failure.
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+	// Failures is the number of failures in a row of a failure event.
+	Failures int `json:"failures,omitempty"`
+}
+
+// webhookConfig is an endpoint notified of the events.
+type webhookConfig struct {
+	// Name identifies the webhook in the logs, the scheme and host of its
+	// URL by default. The URL itself is not logged, it often holds a secret.
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Events lists the events sent, all of them by default.
+	Events []string `yaml:"events"`
+	// Headers are added to the request, e.g. to pass an API token.
+	Headers map[string]string `yaml:"headers"`
+	// Body is a text/template rendering the request body from the event,
+	// the event as JSON by default.
+	Body        string `yaml:"body"`
+	ContentType string `yaml:"content_type"`
+	// Failures is the number of failures in a row sending the failure
+	// event.
+	Failures int `yaml:"failures"`
+
+	tmpl *template.Template
+}
+
+var webhookFuncs = template.FuncMap{
+	// json encodes the value, e.g. to quote a string in a JSON body.
+	"json": func(v any) (string, error) {
+		var b strings.Builder
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(b.String(), "\n"), nil
+	},
+}
+
+func (c *webhookConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain webhookConfig
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		if c.Name == "" {
+			return errors.New("webhook: invalid url")
+		}
+		return fmt.Errorf("webhook %s: invalid url", c.Name)
+	}
+	if c.Name == "" {
+		c.Name = u.Scheme + "://" + u.Host
+	}
+
+	for _, event := range c.Events {
+		if event != webhookEventUpdate && event != webhookEventFailure {
+			return fmt.Errorf("webhook %s: invalid event %q", c.Name, event)
+		}
+	}
+
+	if c.Failures < 0 {
+		return fmt.Errorf("webhook %s: invalid failures %d", c.Name, c.Failures)
+	}
+
+	if c.Body != "" {
+		tmpl, err := template.New(c.Name).Funcs(webhookFuncs).Option("missingkey=error").Parse(c.Body)
+		if err != nil {
+			return fmt.Errorf("webhook %s: invalid body: %w", c.Name, err)
+		}
+		c.tmpl = tmpl
+	}
+
+	return nil
+}
+
+func (c webhookConfig) failures() int {
+	if c.Failures == 0 {
+		return defaultWebhookFailures
+	}
+
+	return c.Failures
+}
+
+// wants returns true if the event is sent to the webhook. A failure event is
+// only sent when the number of failures reaches the threshold, once per
+// series of failures.
+func (c webhookConfig) wants(e webhookEvent) bool {
+	if len(c.Events) > 0 && !slices.Contains(c.Events, e.Event) {
+		return false
+	}
+
+	return e.Event != webhookEventFailure || e.Failures == c.failures()
+}
+
+// render returns the body of the request and its content type.
+func (c webhookConfig) render(e webhookEvent) ([]byte, string, error) {
+	contentType := c.ContentType
+	if c.tmpl == nil {
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		body, err := json.Marshal(e)
+		return body, contentType, err
+	}
+
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	var body bytes.Buffer
+	if err := c.tmpl.Execute(&body, e); err != nil {
+		return nil, "", err
+	}
+
+	return body.Bytes(), contentType, nil
+}
+
+// webhookNotifier delivers the events in the background. A nil
+// webhookNotifier sends nothing.
+type webhookNotifier struct {
+	client *http.Client
+	// retryDelay is the delay before the first retry, doubled after each
+	// attempt.
+	retryDelay time.Duration
+	wg         sync.WaitGroup
+
+	mu    sync.Mutex
+	hooks []webhookConfig
+}
+
+func newWebhookNotifier(hooks []webhookConfig) *webhookNotifier {
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	return &webhookNotifier{
+		client:     &http.Client{Timeout: webhookTimeout},
+		hooks:      hooks,
+		retryDelay: webhookRetryDelay,
+	}
+}
+
+// setHooks replaces the webhooks notified of the next events, e.g. on
+// reload. The pending deliveries go on.
+func (n *webhookNotifier) setHooks(hooks []webhookConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.hooks = hooks
+}
+
+// notify sends the event to the webhooks wanting it, without waiting for the
+// deliveries.
+func (n *webhookNotifier) notify(ctx context.Context, e webhookEvent) {
+	if n == nil {
+		return
+	}
+
+	ctx = backgroundContext(ctx)
+	n.mu.Lock()
+	hooks := n.hooks
+	n.mu.Unlock()
+
+	for _, hook := range hooks {
+		if !hook.wants(e) {
+			continue
+		}
+
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			n.deliver(ctx, hook, e)
+		}()
+	}
+}
+
+// wait waits for the pending deliveries.
+func (n *webhookNotifier) wait() {
+	if n != nil {
+		n.wg.Wait()
+	}
+}
+
+// deliver posts the event to the webhook, retrying with a growing delay.
+func (n *webhookNotifier) deliver(ctx context.Context, hook webhookConfig, e webhookEvent) {
+	body, contentType, err := hook.render(e)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to render the webhook body", "webhook", hook.Name, "hostname", e.Hostname, "error", err)
+		return
+	}
+
+	delay := n.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := n.post(ctx, hook, body, contentType)
+		if err == nil {
+			slog.DebugContext(ctx, "webhook delivered", "webhook", hook.Name, "event", e.Event, "hostname", e.Hostname)
+			return
+		}
+
+		if attempt >= webhookAttempts || isPermanent(err) {
+			slog.ErrorContext(ctx, "failed to deliver the webhook", "webhook", hook.Name, "event", e.Event,
+				"hostname", e.Hostname, "attempts", attempt, "error", err)
+			return
+		}
+
+		slog.WarnContext(ctx, "webhook delivery failed, retrying", "webhook", hook.Name, "event", e.Event,
+			"hostname", e.Hostname, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (n *webhookNotifier) post(ctx context.Context, hook webhookConfig, body []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanent(err)
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range hook.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		// Keep the URL out of the error.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, webhookMaxBodySize))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	default:
+		return permanent(fmt.Errorf("webhook answered %s", resp.Status))
+	}
+}
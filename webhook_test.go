@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestWebhookConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		wantName string
+		wantErr  bool
+	}{
+		{
+			name:     "url only",
+			yaml:     "url: https://ntfy.sh/waybackd",
+			wantName: "https://ntfy.sh",
+		},
+		{
+			name:     "templated body",
+			yaml:     "name: slack\nurl: https://hooks.slack.com/services/T/B/X\nevents: [update]\nbody: '{\"text\": {{json .Hostname}}}'",
+			wantName: "slack",
+		},
+		{
+			name:    "missing url",
+			yaml:    "events: [update]",
+			wantErr: true,
+		},
+		{
+			name:    "invalid scheme",
+			yaml:    "url: ftp://example.com",
+			wantErr: true,
+		},
+		{
+			name:    "invalid event",
+			yaml:    "url: https://ntfy.sh/waybackd\nevents: [deleted]",
+			wantErr: true,
+		},
+		{
+			name:    "invalid template",
+			yaml:    "url: https://ntfy.sh/waybackd\nbody: '{{.Hostname'",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var c webhookConfig
+			err := yaml.Unmarshal([]byte(tc.yaml), &c)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Name != tc.wantName {
+				t.Fatalf("got name %q, want %q", c.Name, tc.wantName)
+			}
+		})
+	}
+}
+
+func testWebhook(t *testing.T, text string) webhookConfig {
+	t.Helper()
+
+	var c webhookConfig
+	if err := yaml.Unmarshal([]byte(text), &c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestWebhookWants(t *testing.T) {
+	update := webhookEvent{Event: webhookEventUpdate}
+	failure := func(n int) webhookEvent {
+		return webhookEvent{Event: webhookEventFailure, Failures: n}
+	}
+
+	tests := []struct {
+		name  string
+		yaml  string
+		event webhookEvent
+		want  bool
+	}{
+		{name: "update by default", yaml: "url: http://hook", event: update, want: true},
+		{name: "failure below the default threshold", yaml: "url: http://hook", event: failure(2)},
+		{name: "failure at the default threshold", yaml: "url: http://hook", event: failure(3), want: true},
+		{name: "failure past the threshold", yaml: "url: http://hook", event: failure(4)},
+		{name: "failure at the threshold", yaml: "url: http://hook\nfailures: 1", event: failure(1), want: true},
+		{name: "filtered event", yaml: "url: http://hook\nevents: [failure]", event: update},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := testWebhook(t, tc.yaml).wants(tc.event); got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWebhookRender(t *testing.T) {
+	e := webhookEvent{
+		Event:    webhookEventUpdate,
+		Hostname: "home.example.com",
+		Type:     recordTypeA,
+		OldIP:    "198.51.100.1",
+		NewIP:    "203.0.113.1",
+		Time:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Result:   "success",
+	}
+
+	tests := []struct {
+		name            string
+		yaml            string
+		wantBody        string
+		wantContentType string
+	}{
+		{
+			name:            "json event",
+			yaml:            "url: http://hook",
+			wantBody:        `{"event":"update","hostname":"home.example.com","type":"A","old_ip":"198.51.100.1","new_ip":"203.0.113.1","time":"2024-01-02T03:04:05Z","result":"success"}`,
+			wantContentType: "application/json",
+		},
+		{
+			name:            "plain text",
+			yaml:            "url: http://hook\nbody: '{{.Hostname}} now points to {{.NewIP}}'",
+			wantBody:        "home.example.com now points to 203.0.113.1",
+			wantContentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:            "slack",
+			yaml:            "url: http://hook\ncontent_type: application/json\nbody: '{\"text\": {{json (printf \"%s: %s -> %s\" .Hostname .OldIP .NewIP)}}}'",
+			wantBody:        `{"text": "home.example.com: 198.51.100.1 -> 203.0.113.1"}`,
+			wantContentType: "application/json",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			body, contentType, err := testWebhook(t, tc.yaml).render(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(body) != tc.wantBody {
+				t.Fatalf("got body %s, want %s", body, tc.wantBody)
+			}
+			if contentType != tc.wantContentType {
+				t.Fatalf("got content type %q, want %q", contentType, tc.wantContentType)
+			}
+		})
+	}
+}
+
+// testWebhookServer answers with the given statuses in turn, then 200, and
+// records the requests.
+type testWebhookServer struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+	headers  []http.Header
+}
+
+func (s *testWebhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	s.bodies = append(s.bodies, string(body))
+	s.headers = append(s.headers, r.Header.Clone())
+	if len(s.statuses) > 0 {
+		w.WriteHeader(s.statuses[0])
+		s.statuses = s.statuses[1:]
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		want     int
+	}{
+		{name: "delivered", want: 1},
+		{name: "retried", statuses: []int{503, http.StatusTooManyRequests}, want: 3},
+		{name: "refused", statuses: []int{400}, want: 1},
+		{name: "gave up", statuses: []int{500, 500, 500, 500, 500}, want: webhookAttempts},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server := &testWebhookServer{statuses: tc.statuses}
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+
+			n := newWebhookNotifier([]webhookConfig{
+				testWebhook(t, fmt.Sprintf("url: %s\nheaders:\n  Authorization: Bearer token", ts.URL)),
+			})
+			n.retryDelay = time.Millisecond
+
+			n.notify(context.Background(), webhookEvent{Event: webhookEventUpdate, Hostname: "home.example.com"})
+			n.wait()
+
+			if len(server.bodies) != tc.want {
+				t.Fatalf("got %d requests, want %d", len(server.bodies), tc.want)
+			}
+			if got := server.headers[0].Get("Authorization"); got != "Bearer token" {
+				t.Fatalf("got authorization %q", got)
+			}
+		})
+	}
+}
+
+func TestUpdateDomainsWebhooks(t *testing.T) {
+	server := &testWebhookServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	ip := netip.MustParseAddr("203.0.113.1")
+	oldIP := netip.MustParseAddr("198.51.100.1")
+	home := testDomain()
+	backend := newMockBackend()
+	backend.records[mockBackendKey(home, recordTypeA)] = record{ID: "1", Type: recordTypeA, Target: oldIP.String()}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	a := &app{
+		config: config{
+			Provider: testProviders,
+			Domains:  []domain{home},
+		},
+		backends:    map[string]DNSBackend{defaultBackend: backend},
+		ipProvider:  &mockIPProvider{addr: ip},
+		dnsProvider: &mockDNSProvider{addr: oldIP},
+		webhooks:    newWebhookNotifier([]webhookConfig{testWebhook(t, fmt.Sprintf("url: %s\nfailures: 2", ts.URL))}),
+		clock:       func() time.Time { return now },
+	}
+
+	a.tryUpdateDomainsIfNeeded(context.Background())
+	a.webhooks.wait()
+
+	// Two failures in a row send a single failure event.
+	backend.err = fmt.Errorf("api unavailable")
+	for range 3 {
+		a.tryUpdateDomainsIfNeeded(context.Background())
+	}
+	a.webhooks.wait()
+
+	var events []webhookEvent
+	for _, body := range server.bodies {
+		var e webhookEvent
+		if err := json.Unmarshal([]byte(body), &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+
+	want := []webhookEvent{
+		{
+			Event:    webhookEventUpdate,
+			Hostname: home.hostname(),
+			Type:     recordTypeA,
+			OldIP:    oldIP.String(),
+			NewIP:    ip.String(),
+			Time:     now,
+			Result:   "success",
+		},
+		{
+			Event:    webhookEventFailure,
+			Hostname: home.hostname(),
+			Time:     now,
+			Result:   "failure",
+			Error:    "api unavailable",
+			Failures: 2,
+		},
+	}
+
+	if len(events) != len(want) {
+		t.Fatalf("got events %+v, want %+v", events, want)
+	}
+	for i := range want {
+		if !events[i].Time.Equal(want[i].Time) {
+			t.Fatalf("got event time %s, want %s", events[i].Time, want[i].Time)
+		}
+		events[i].Time = want[i].Time
+		if events[i] != want[i] {
+			t.Fatalf("got event %+v, want %+v", events[i], want[i])
+		}
+	}
+}
+
+func TestUpdateDomainsWebhookLogs(t *testing.T) {
+	out := testDefaultLogger(t)
+	server := &testWebhookServer{statuses: []int{http.StatusBadRequest}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	ip := netip.MustParseAddr("203.0.113.1")
+	home := testDomain()
+	a := &app{
+		config: config{
+			Provider: testProviders,
+			Domains:  []domain{home},
+		},
+		backends:    map[string]DNSBackend{defaultBackend: newMockBackend()},
+		ipProvider:  &mockIPProvider{addr: ip},
+		dnsProvider: &mockDNSProvider{addr: netip.MustParseAddr("198.51.100.1")},
+		webhooks:    newWebhookNotifier([]webhookConfig{testWebhook(t, "url: "+ts.URL+"/services/T000/B000/SECRET")}),
+	}
+
+	// The delivery outlives the buffered logs of the update.
+	a.tryUpdateDomainsIfNeeded(context.Background())
+	a.webhooks.wait()
+
+	logs := out.String()
+	if !strings.Contains(logs, "failed to deliver the webhook") || !strings.Contains(logs, "webhook="+ts.URL) {
+		t.Fatalf("expected the delivery failure to be logged, got:\n%s", logs)
+	}
+	if strings.Contains(logs, "SECRET") {
+		t.Fatalf("expected the webhook URL to be left out of the logs, got:\n%s", logs)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// namedRecord is a record along with its subdomain in the zone, empty for
+// the apex.
+type namedRecord struct {
+	SubDomain string
+	record
+}
+
+// parseZoneFile returns the A and AAAA records of a zone file in the RFC 1035
+// master file format, such as exported by OVH. The other records are
+// ignored.
+func parseZoneFile(zone, text string) ([]namedRecord, error) {
+	origin := strings.ToLower(strings.TrimSuffix(zone, ".")) + "."
+	var defaultTTL time.Duration
+	var owner string
+	var records []namedRecord
+
+	for i, line := range zoneFileLines(text) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("zone file line %d: missing origin", i+1)
+			}
+			origin = zoneFileName(fields[1], origin)
+			continue
+		case "$TTL":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("zone file line %d: missing TTL", i+1)
+			}
+			ttl, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("zone file line %d: invalid TTL: %w", i+1, err)
+			}
+			defaultTTL = time.Duration(ttl) * time.Second
+			continue
+		}
+
+		// A line starting with a blank uses the previous owner.
+		if line[0] != ' ' && line[0] != '\t' {
+			owner = zoneFileName(fields[0], origin)
+			fields = fields[1:]
+		}
+
+		ttl := defaultTTL
+		var rtype string
+		for len(fields) > 0 && rtype == "" {
+			field := fields[0]
+			fields = fields[1:]
+			if v, err := strconv.ParseUint(field, 10, 32); err == nil {
+				ttl = time.Duration(v) * time.Second
+				continue
+			}
+
+			switch strings.ToUpper(field) {
+			case "IN", "CH", "HS", "CS":
+			default:
+				rtype = strings.ToUpper(field)
+			}
+		}
+
+		t := recordType(rtype)
+		if !t.valid() {
+			continue
+		}
+
+		if owner == "" || len(fields) != 1 {
+			return nil, fmt.Errorf("zone file line %d: invalid %s record", i+1, t)
+		}
+
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || !t.match(addr) {
+			return nil, fmt.Errorf("zone file line %d: invalid %s address %q", i+1, t, fields[0])
+		}
+
+		sub, ok := zoneFileSubDomain(owner, zone)
+		if !ok {
+			continue
+		}
+
+		records = append(records, namedRecord{
+			SubDomain: sub,
+			record: record{
+				Type:   t,
+				Target: addr.String(),
+				TTL:    ttl,
+			},
+		})
+	}
+
+	return records, nil
+}
+
+// zoneFileLines returns the lines of the zone file without the comments.
+// The lines of a parenthesized entry are joined on its last line, the
+// others being left empty to keep the line numbers.
+func zoneFileLines(text string) []string {
+	var lines []string
+	var entry strings.Builder
+	depth := 0
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(stripZoneFileComment(line), " \t\r")
+		if depth == 0 {
+			entry.Reset()
+		} else {
+			entry.WriteByte(' ')
+		}
+
+		quoted := false
+		for _, c := range line {
+			switch {
+			case c == '"':
+				quoted = !quoted
+			case c == '(' && !quoted:
+				depth++
+				c = ' '
+			case c == ')' && !quoted:
+				depth = max(depth-1, 0)
+				c = ' '
+			}
+			entry.WriteRune(c)
+		}
+
+		if depth == 0 {
+			lines = append(lines, entry.String())
+		} else {
+			lines = append(lines, "")
+		}
+	}
+
+	return lines
+}
+
+// stripZoneFileComment removes the comment of the line, ignoring the
+// semicolons found in quoted strings.
+func stripZoneFileComment(line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+
+	return line
+}
+
+// zoneFileName returns the fully qualified name of a zone file name,
+// relative to the origin unless it ends with a dot.
+func zoneFileName(name, origin string) string {
+	name = strings.ToLower(name)
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return name
+	default:
+		return name + "." + origin
+	}
+}
+
+// zoneFileSubDomain returns the subdomain of the fully qualified name in the
+// zone, or false if the name is outside of the zone.
+func zoneFileSubDomain(name, zone string) (string, bool) {
+	zone = strings.ToLower(strings.TrimSuffix(zone, ".")) + "."
+	if name == zone {
+		return "", true
+	}
+
+	sub, ok := strings.CutSuffix(name, "."+zone)
+	if !ok {
+		return "", false
+	}
+
+	return sub, true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+const testZoneFile = `$TTL 3600
+@	IN SOA dns200.anycast.me. tech.ovh.net. (2024060301 86400 3600 3600000 60)
+                          IN NS     dns200.anycast.me.
+                          IN NS     ns200.anycast.me.
+                          IN A      203.0.113.10
+home                      IN A      203.0.113.1 ; router
+home                      IN AAAA   2001:db8::1
+nas                60     IN A      198.51.100.1
+NAS.example.com.          IN AAAA   2001:db8::2
+www                       IN CNAME  home
+_dmarc                    IN TXT    "v=DMARC1; p=none; (test"
+$ORIGIN lab.example.com.
+vm                        IN A      192.0.2.1
+other.example.org.        IN A      192.0.2.2
+`
+
+func TestParseZoneFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "ovh export",
+			text: testZoneFile,
+			want: []string{
+				"/A 203.0.113.10 1h0m0s",
+				"home/A 203.0.113.1 1h0m0s",
+				"home/AAAA 2001:db8::1 1h0m0s",
+				"nas/A 198.51.100.1 1m0s",
+				"nas/AAAA 2001:db8::2 1h0m0s",
+				"vm.lab/A 192.0.2.1 1h0m0s",
+			},
+		},
+		{
+			name: "multi line entry",
+			text: "home (\n  60 IN A\n  203.0.113.1 )\nnas IN A 198.51.100.1\n",
+			want: []string{
+				"home/A 203.0.113.1 1m0s",
+				"nas/A 198.51.100.1 0s",
+			},
+		},
+		{
+			name:    "invalid address",
+			text:    "home IN A 2001:db8::1\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid TTL",
+			text:    "$TTL 1h\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			records, err := parseZoneFile("example.com", tc.text)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var got []string
+			for _, r := range records {
+				got = append(got, fmt.Sprintf("%s/%s %s %s", r.SubDomain, r.Type, r.Target, r.TTL))
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestZoneFileSubDomain(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   string
+		wantOK bool
+	}{
+		{name: "example.com.", want: "", wantOK: true},
+		{name: "home.example.com.", want: "home", wantOK: true},
+		{name: "vm.lab.example.com.", want: "vm.lab", wantOK: true},
+		{name: "home.notexample.com."},
+		{name: "example.org."},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := zoneFileSubDomain(tc.name, "example.com")
+			if got != tc.want || ok != tc.wantOK {
+				t.Fatalf("got %q, %v, want %q, %v", got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}